@@ -1,6 +1,7 @@
 package graphqlbackend
 
 import (
+	"bytes"
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
@@ -8,6 +9,7 @@ import (
 	"io"
 	"strings"
 	"sync"
+	"unicode/utf8"
 
 	"github.com/sourcegraph/go-diff/diff"
 	"github.com/sourcegraph/sourcegraph/cmd/frontend/backend"
@@ -287,6 +289,80 @@ func (r *fileDiffResolver) Stat() *diffStat {
 	}
 }
 
+// maxDiffLineLength is the number of characters above which an added line
+// gets a LONG_LINE warning.
+const maxDiffLineLength = 500
+
+const (
+	fileDiffWarningNoTrailingNewline = "NO_TRAILING_NEWLINE"
+	fileDiffWarningMixedIndentation  = "MIXED_INDENTATION"
+	fileDiffWarningLongLine          = "LONG_LINE"
+)
+
+func (r *fileDiffResolver) Warnings() []*fileDiffWarning {
+	warnings := []*fileDiffWarning{}
+	for _, hunk := range r.fileDiff.Hunks {
+		body := hunk.Body
+		// A hunk body without a trailing newline means the new file has no
+		// newline at the end, and the old file neither if the last line is
+		// unchanged. A missing newline only in the old file is recorded in
+		// OrigNoNewlineAt.
+		newMissing := len(body) > 0 && body[len(body)-1] != '\n'
+		lines := bytes.Split(bytes.TrimSuffix(body, []byte("\n")), []byte("\n"))
+		lastLine := lines[len(lines)-1]
+		if hunk.OrigNoNewlineAt != 0 || (newMissing && len(lastLine) > 0 && lastLine[0] == ' ') {
+			warnings = append(warnings, &fileDiffWarning{kind: fileDiffWarningNoTrailingNewline, message: "The old file has no newline at the end."})
+		}
+		if newMissing {
+			warnings = append(warnings, &fileDiffWarning{kind: fileDiffWarningNoTrailingNewline, message: "The new file has no newline at the end."})
+		}
+
+		line := hunk.NewStartLine
+		for _, l := range lines {
+			if len(l) == 0 || l[0] == '-' {
+				continue
+			}
+			if l[0] == '+' {
+				warnings = append(warnings, addedLineWarnings(l[1:], line)...)
+			}
+			line++
+		}
+	}
+	return warnings
+}
+
+// addedLineWarnings returns the warnings about the added line content, which
+// is line of the new file.
+func addedLineWarnings(content []byte, line int32) []*fileDiffWarning {
+	var warnings []*fileDiffWarning
+	indent := content[:len(content)-len(bytes.TrimLeft(content, " \t"))]
+	if bytes.IndexByte(indent, ' ') >= 0 && bytes.IndexByte(indent, '\t') >= 0 {
+		warnings = append(warnings, &fileDiffWarning{
+			kind:    fileDiffWarningMixedIndentation,
+			line:    &line,
+			message: fmt.Sprintf("Line %d is indented with both tabs and spaces.", line),
+		})
+	}
+	if utf8.RuneCount(content) > maxDiffLineLength {
+		warnings = append(warnings, &fileDiffWarning{
+			kind:    fileDiffWarningLongLine,
+			line:    &line,
+			message: fmt.Sprintf("Line %d is longer than %d characters.", line, maxDiffLineLength),
+		})
+	}
+	return warnings
+}
+
+type fileDiffWarning struct {
+	kind    string
+	line    *int32
+	message string
+}
+
+func (r *fileDiffWarning) Kind() string    { return r.kind }
+func (r *fileDiffWarning) Line() *int32    { return r.line }
+func (r *fileDiffWarning) Message() string { return r.message }
+
 func (r *fileDiffResolver) OldFile() *gitTreeEntryResolver {
 	if diffPathOrNull(r.fileDiff.OrigName) == nil {
 		return nil
@@ -0,0 +1,64 @@
+package graphqlbackend
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sourcegraph/go-diff/diff"
+)
+
+func TestFileDiffResolver_Warnings(t *testing.T) {
+	type warning struct {
+		kind string
+		line int32
+	}
+	tests := []struct {
+		name string
+		diff string
+		want []warning
+	}{{
+		name: "none",
+		diff: "@@ -1,2 +1,2 @@\n a\n-b\n+c\n",
+		want: []warning{},
+	}, {
+		name: "no trailing newline in new file",
+		diff: "@@ -1 +1 @@\n-a\n+b\n\\ No newline at end of file\n",
+		want: []warning{{kind: fileDiffWarningNoTrailingNewline}},
+	}, {
+		name: "no trailing newline in old file",
+		diff: "@@ -1 +1 @@\n-a\n\\ No newline at end of file\n+b\n",
+		want: []warning{{kind: fileDiffWarningNoTrailingNewline}},
+	}, {
+		name: "no trailing newline in either file",
+		diff: "@@ -1,2 +1,2 @@\n-a\n+b\n c\n\\ No newline at end of file\n",
+		want: []warning{{kind: fileDiffWarningNoTrailingNewline}, {kind: fileDiffWarningNoTrailingNewline}},
+	}, {
+		name: "mixed indentation",
+		diff: "@@ -10,2 +10,3 @@\n a\n+\tb\n+ \tc\n-d\n+  e\n",
+		want: []warning{{kind: fileDiffWarningMixedIndentation, line: 12}},
+	}, {
+		name: "long line",
+		diff: "@@ -1,2 +1,2 @@\n a\n+" + strings.Repeat("x", maxDiffLineLength+1) + "\n-" + strings.Repeat("y", maxDiffLineLength+1) + "\n",
+		want: []warning{{kind: fileDiffWarningLongLine, line: 2}},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fileDiff, err := diff.ParseFileDiff([]byte("--- a/f\n+++ b/f\n" + test.diff))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []warning{}
+			for _, w := range (&fileDiffResolver{fileDiff: fileDiff}).Warnings() {
+				var line int32
+				if w.Line() != nil {
+					line = *w.Line()
+				}
+				got = append(got, warning{kind: w.Kind(), line: line})
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got warnings %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
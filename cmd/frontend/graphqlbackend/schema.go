@@ -1768,6 +1768,9 @@ type FileDiff {
     hunks: [FileDiffHunk!]!
     # The diff stat for the whole file.
     stat: DiffStat!
+    # Advisory warnings about the changes, such as a missing trailing newline. They don't affect
+    # the diff.
+    warnings: [FileDiffWarning!]!
     # FOR INTERNAL USE ONLY.
     #
     # An identifier for the file diff that is unique among all other file diffs in the list that
@@ -1775,6 +1778,27 @@ type FileDiff {
     internalID: String!
 }
 
+# An advisory warning about a file diff.
+type FileDiffWarning {
+    # The kind of warning.
+    kind: FileDiffWarningKind!
+    # The line of the new file that the warning applies to, or null if it applies to the whole
+    # file.
+    line: Int
+    # A human-readable description of the warning.
+    message: String!
+}
+
+# All possible kinds of file diff warnings.
+enum FileDiffWarningKind {
+    # The old or new file has no newline at the end.
+    NO_TRAILING_NEWLINE
+    # An added line is indented with both tabs and spaces.
+    MIXED_INDENTATION
+    # An added line is very long.
+    LONG_LINE
+}
+
 # A changed region ("hunk") in a file diff.
 type FileDiffHunk {
     # The range of the old file that the hunk applies to.
@@ -2,13 +2,18 @@
 package main // import "github.com/sourcegraph/sourcegraph/cmd/gitserver"
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"log"
+	"math"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -19,16 +24,42 @@ import (
 	"gopkg.in/inconshreveable/log15.v2"
 
 	"github.com/sourcegraph/sourcegraph/cmd/gitserver/server"
+	"github.com/sourcegraph/sourcegraph/internal/api"
 	"github.com/sourcegraph/sourcegraph/internal/debugserver"
 	"github.com/sourcegraph/sourcegraph/internal/env"
+	"github.com/sourcegraph/sourcegraph/internal/gitserver/protocol"
 	"github.com/sourcegraph/sourcegraph/internal/tracer"
 )
 
 var (
 	reposDir          = env.Get("SRC_REPOS_DIR", "/data/repos", "Root dir containing repos.")
+	storageLimits     = env.Get("SRC_REPOS_DIR_STORAGE_CLONE_LIMITS", "", "JSON object mapping directories in $SRC_REPOS_DIR on separate storage devices (e.g. \"github.com\") to the number of concurrent clones and fetches of the repositories below them.")
+	prevReposDir      = env.Get("SRC_REPOS_DIR_PREVIOUS", "", "Previous $SRC_REPOS_DIR after relocating gitserver storage. Its repos are moved to $SRC_REPOS_DIR in the background.")
 	runRepoCleanup, _ = strconv.ParseBool(env.Get("SRC_RUN_REPO_CLEANUP", "", "Periodically remove inactive repositories."))
 	wantPctFree       = env.Get("SRC_REPOS_DESIRED_PERCENT_FREE", "10", "Target percentage of free space on disk.")
 	janitorInterval   = env.Get("SRC_REPOS_JANITOR_INTERVAL", "1m", "Interval between cleanup runs")
+	cloneWorkTree, _  = strconv.ParseBool(env.Get("SRC_REPOS_WORK_TREE", "", "Check out a work tree next to each repository, for integrations which read files directly."))
+	evictionGrace     = env.Get("SRC_REPOS_EVICTION_GRACE_PERIOD", "0", "How long to keep a repository selected for removal to free up disk space before removing it. Accessing it in the meantime cancels the removal.")
+
+	packWindowMemory = env.Get("SRC_GIT_PACK_WINDOW_MEMORY", "", "Value for git's pack.windowMemory during clone and fetch (e.g. 100m).")
+	packSizeLimit    = env.Get("SRC_GIT_PACK_SIZE_LIMIT", "", "Value for git's pack.packSizeLimit during clone and fetch (e.g. 2g).")
+	bigFileThreshold = env.Get("SRC_GIT_BIG_FILE_THRESHOLD", "", "Value for git's core.bigFileThreshold during clone and fetch (e.g. 50m).")
+	gitNice          = env.Get("SRC_GIT_NICE", "0", "Niceness adjustment for background git clone and fetch processes (see nice(1)).")
+	gitIONiceClass   = env.Get("SRC_GIT_IONICE_CLASS", "0", "IO scheduling class for background git clone and fetch processes (see ionice(1)): 2 best-effort or 3 idle. 0 leaves it unchanged.")
+	gitCompression   = env.Get("SRC_GIT_COMPRESSION", "", "zlib compression level (-1 to 9) for objects written by git clone, fetch and repack (core.compression). Empty uses git's default.")
+	gitHooksDir      = env.Get("SRC_GIT_HOOKS_DIR", "", "Directory of git hooks to use when cloning and fetching (core.hooksPath).")
+	postFetchCommand = env.Get("SRC_GIT_POST_FETCH_COMMAND", "", "Absolute path to an executable run after every successful fetch, with the repository passed via $SRC_REPO_NAME and $SRC_REPO_DIR.")
+	gitUserAgent     = env.Get("SRC_GIT_USER_AGENT", "", "User agent for git clone and fetch over HTTP (http.userAgent). Empty uses git's default.")
+	gitUserAgents    = env.Get("SRC_GIT_USER_AGENT_OVERRIDES", "", "JSON object mapping URL prefixes (e.g. https://github.com) to the user agent used for matching remotes instead of $SRC_GIT_USER_AGENT.")
+	resolveOverrides = env.Get("SRC_GIT_HOST_RESOLVE_OVERRIDES", "", "JSON object mapping hosts (e.g. github.com or github.com:8443) of HTTP(S) remotes to the IP address git connects to instead of resolving them. Requires git 2.37.")
+	repoOptions      = env.Get("SRC_GIT_REPO_OPTIONS", "", "JSON object mapping repository names to per-repository git option overrides.")
+	fetchFsck, _     = strconv.ParseBool(env.Get("SRC_GIT_FETCH_FSCK", "", "Fetch into a quarantine and check connectivity with git fsck before updating the repository."))
+	fetchSkipping, _ = strconv.ParseBool(env.Get("SRC_GIT_FETCH_NEGOTIATION_SKIPPING", "", "Use git's skipping negotiation algorithm for fetches (requires git 2.19)."))
+	gzipResponses, _ = strconv.ParseBool(env.Get("SRC_GITSERVER_GZIP_RESPONSES", "", "Compress exec responses for clients which accept gzip."))
+	execIdleTimeout  = env.Get("SRC_GITSERVER_EXEC_IDLE_TIMEOUT", "0", "How long writing an exec response may make no progress before the command is cancelled. 0 disables it.")
+	maxFetchSize     = env.Get("SRC_GIT_MAX_FETCH_SIZE", "0", "Maximum number of bytes of objects a fetch may add to a repository. Larger fetches are rejected without changing the repository. 0 disables the limit.")
+	breakerThresh    = env.Get("SRC_GIT_FETCH_BREAKER_THRESHOLD", "0", "Number of consecutive network failures fetching from a code host after which fetches from it fail fast. 0 disables the circuit breaker.")
+	breakerCooldown  = env.Get("SRC_GIT_FETCH_BREAKER_COOLDOWN", "5m", "How long fetches from a code host fail fast once $SRC_GIT_FETCH_BREAKER_THRESHOLD is reached.")
 )
 
 func main() {
@@ -47,10 +78,108 @@ func main() {
 	if err != nil {
 		log.Fatalf("parsing $SRC_REPOS_DESIRED_PERCENT_FREE: %v", err)
 	}
+	evictionGrace2, err := time.ParseDuration(evictionGrace)
+	if err != nil {
+		log.Fatalf("parsing $SRC_REPOS_EVICTION_GRACE_PERIOD: %v", err)
+	}
+	gitNice2, err := parseIntInRange(gitNice, -20, 19)
+	if err != nil {
+		log.Fatalf("parsing $SRC_GIT_NICE: %v", err)
+	}
+	gitIONiceClass2, err := parseIONiceClass(gitIONiceClass)
+	if err != nil {
+		log.Fatalf("parsing $SRC_GIT_IONICE_CLASS: %v", err)
+	}
+	if gitCompression != "" {
+		if _, err := parseIntInRange(gitCompression, -1, 9); err != nil {
+			log.Fatalf("parsing $SRC_GIT_COMPRESSION: %v", err)
+		}
+	}
+	gitHooksDir2, err := validateHooksDir(gitHooksDir)
+	if err != nil {
+		log.Fatalf("checking $SRC_GIT_HOOKS_DIR: %v", err)
+	}
+	if postFetchCommand != "" && !filepath.IsAbs(postFetchCommand) {
+		log.Fatal("$SRC_GIT_POST_FETCH_COMMAND must be an absolute path")
+	}
+	var storageLimits2 map[string]int
+	if storageLimits != "" {
+		if err := json.Unmarshal([]byte(storageLimits), &storageLimits2); err != nil {
+			log.Fatalf("parsing $SRC_REPOS_DIR_STORAGE_CLONE_LIMITS: %v", err)
+		}
+		if err := server.ValidateStorageCloneLimits(storageLimits2); err != nil {
+			log.Fatalf("parsing $SRC_REPOS_DIR_STORAGE_CLONE_LIMITS: %v", err)
+		}
+	}
+	var resolveOverrides2 map[string]string
+	if resolveOverrides != "" {
+		if err := json.Unmarshal([]byte(resolveOverrides), &resolveOverrides2); err != nil {
+			log.Fatalf("parsing $SRC_GIT_HOST_RESOLVE_OVERRIDES: %v", err)
+		}
+		if err := server.ValidateHostResolveOverrides(resolveOverrides2); err != nil {
+			log.Fatalf("parsing $SRC_GIT_HOST_RESOLVE_OVERRIDES: %v", err)
+		}
+	}
+	gitUserAgents2, err := parseUserAgentOverrides(gitUserAgents)
+	if err != nil {
+		log.Fatalf("parsing $SRC_GIT_USER_AGENT_OVERRIDES: %v", err)
+	}
+	if strings.ContainsAny(gitUserAgent, "\r\n") {
+		log.Fatal("$SRC_GIT_USER_AGENT must not contain newlines")
+	}
+	repoOptions2, err := parseRepoOptions(repoOptions)
+	if err != nil {
+		log.Fatalf("parsing $SRC_GIT_REPO_OPTIONS: %v", err)
+	}
+	execIdleTimeout2, err := time.ParseDuration(execIdleTimeout)
+	if err != nil {
+		log.Fatalf("parsing $SRC_GITSERVER_EXEC_IDLE_TIMEOUT: %v", err)
+	}
+	maxFetchSize2, err := strconv.ParseInt(maxFetchSize, 10, 64)
+	if err != nil || maxFetchSize2 < 0 {
+		log.Fatalf("parsing $SRC_GIT_MAX_FETCH_SIZE: invalid size %q", maxFetchSize)
+	}
+	breakerThresh2, err := parseIntInRange(breakerThresh, 0, math.MaxInt32)
+	if err != nil {
+		log.Fatalf("parsing $SRC_GIT_FETCH_BREAKER_THRESHOLD: %v", err)
+	}
+	breakerCooldown2, err := time.ParseDuration(breakerCooldown)
+	if err != nil {
+		log.Fatalf("parsing $SRC_GIT_FETCH_BREAKER_COOLDOWN: %v", err)
+	}
 	gitserver := server.Server{
 		ReposDir:                reposDir,
+		PreviousReposDir:        prevReposDir,
+		StorageCloneLimits:      storageLimits2,
 		DeleteStaleRepositories: runRepoCleanup,
 		DesiredPercentFree:      wantPctFree2,
+		EvictionGracePeriod:     evictionGrace2,
+		CloneWorkTree:           cloneWorkTree,
+		GitMemoryConfig: server.GitMemoryConfig{
+			PackWindowMemory: packWindowMemory,
+			PackSizeLimit:    packSizeLimit,
+			BigFileThreshold: bigFileThreshold,
+		},
+		GitNice:        gitNice2,
+		GitIONiceClass: gitIONiceClass2,
+		GitCompression: gitCompression,
+		GitHooksDir:    gitHooksDir2,
+		RepoOptions:    repoOptions2,
+
+		GitUserAgent:          gitUserAgent,
+		GitUserAgentOverrides: gitUserAgents2,
+		HostResolveOverrides:  resolveOverrides2,
+
+		MaxFetchSize:             maxFetchSize2,
+		FetchNegotiationSkipping: fetchSkipping,
+		GzipResponses:            gzipResponses,
+		ExecIdleTimeout:          execIdleTimeout2,
+		FetchBreakerThreshold:    breakerThresh2,
+		FetchBreakerCooldown:     breakerCooldown2,
+		PostFetchCommand:         postFetchCommand,
+	}
+	if fetchFsck {
+		gitserver.FetchValidators = append(gitserver.FetchValidators, server.FsckFetchValidator)
 	}
 	gitserver.RegisterMetrics()
 
@@ -67,6 +196,12 @@ func main() {
 
 	go debugserver.Start()
 
+	go func() {
+		if err := gitserver.MigrateRepos(context.Background()); err != nil {
+			log15.Error("git-server: failed to migrate repositories", "error", err)
+		}
+	}()
+
 	janitorInterval2, err := time.ParseDuration(janitorInterval)
 	if err != nil {
 		log.Fatalf("parsing $SRC_REPOS_JANITOR_INTERVAL: %v", err)
@@ -84,7 +219,7 @@ func main() {
 		host = "127.0.0.1"
 	}
 	addr := net.JoinHostPort(host, port)
-	srv := &http.Server{Addr: addr, Handler: handler}
+	srv := &http.Server{Addr: addr, Handler: handler, ConnContext: server.ConnContext}
 	log15.Info("git-server: listening", "addr", srv.Addr)
 
 	go func() {
@@ -125,3 +260,91 @@ func parsePercent(s string) (int, error) {
 	}
 	return p, nil
 }
+
+// parseIntInRange parses s as an integer in the range [min, max].
+func parseIntInRange(s string, min, max int) (int, error) {
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, errors.Wrap(err, "converting string to int")
+	}
+	if i < min || i > max {
+		return 0, fmt.Errorf("value %d is outside of the range [%d, %d]", i, min, max)
+	}
+	return i, nil
+}
+
+// parseIONiceClass parses an IO scheduling class for ionice(1). The realtime
+// class 1 is rejected: it requires CAP_SYS_ADMIN and would let background
+// clones and fetches starve all other IO.
+func parseIONiceClass(s string) (int, error) {
+	class, err := parseIntInRange(s, 0, 3)
+	if err != nil {
+		return 0, err
+	}
+	if class == 1 {
+		return 0, errors.New("the realtime class 1 is not supported")
+	}
+	return class, nil
+}
+
+// validateHooksDir checks that dir, if set, is an existing directory and
+// returns its absolute path. git resolves a relative core.hooksPath against
+// the repository it runs in, so it must be absolute.
+func validateHooksDir(dir string) (string, error) {
+	if dir == "" {
+		return "", nil
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return "", err
+	}
+	if !fi.IsDir() {
+		return "", fmt.Errorf("%s is not a directory", dir)
+	}
+	return dir, nil
+}
+
+// parseUserAgentOverrides parses a JSON object mapping http(s) URL prefixes
+// to user agents.
+func parseUserAgentOverrides(s string) (map[string]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var overrides map[string]string
+	if err := json.Unmarshal([]byte(s), &overrides); err != nil {
+		return nil, errors.Wrap(err, "decoding JSON")
+	}
+	for prefix, userAgent := range overrides {
+		if !strings.HasPrefix(prefix, "https://") && !strings.HasPrefix(prefix, "http://") {
+			return nil, errors.Errorf("URL prefix %q must start with http:// or https://", prefix)
+		}
+		if userAgent == "" || strings.ContainsAny(prefix+userAgent, "\r\n") {
+			return nil, errors.Errorf("invalid user agent %q for %s", userAgent, prefix)
+		}
+	}
+	return overrides, nil
+}
+
+// parseRepoOptions parses a JSON object mapping repository names to
+// server.RepoOptions. The repository names are normalized.
+func parseRepoOptions(s string) (map[api.RepoName]server.RepoOptions, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var raw map[api.RepoName]server.RepoOptions
+	if err := json.Unmarshal([]byte(s), &raw); err != nil {
+		return nil, errors.Wrap(err, "decoding JSON")
+	}
+	opts := make(map[api.RepoName]server.RepoOptions, len(raw))
+	for name, o := range raw {
+		if err := o.Validate(); err != nil {
+			return nil, errors.Wrapf(err, "options for %s", name)
+		}
+		opts[protocol.NormalizeRepo(name)] = o
+	}
+	return opts, nil
+}
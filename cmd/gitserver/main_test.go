@@ -1,7 +1,16 @@
 // gitserver is the gitserver server.
 package main
 
-import "testing"
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/sourcegraph/sourcegraph/cmd/gitserver/server"
+	"github.com/sourcegraph/sourcegraph/internal/api"
+)
 
 func Test_parsePercent(t *testing.T) {
 	tests := []struct {
@@ -30,3 +39,82 @@ func Test_parsePercent(t *testing.T) {
 		})
 	}
 }
+
+func Test_parseIONiceClass(t *testing.T) {
+	for s, want := range map[string]int{"0": 0, "2": 2, "3": 3} {
+		if got, err := parseIONiceClass(s); err != nil || got != want {
+			t.Errorf("parseIONiceClass(%q) = %d, %v, want %d", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "-1", "1", "4"} {
+		if _, err := parseIONiceClass(s); err == nil {
+			t.Errorf("parseIONiceClass(%q): expected error", s)
+		}
+	}
+}
+
+func Test_parseRepoOptions(t *testing.T) {
+	got, err := parseRepoOptions(`{"GitHub.com/Foo/Bar": {"Memory": {"PackWindowMemory": "10m"}}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[api.RepoName]server.RepoOptions{
+		"github.com/foo/bar": {Memory: server.GitMemoryConfig{PackWindowMemory: "10m"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseRepoOptions() = %v, want %v", got, want)
+	}
+
+	if got, err := parseRepoOptions(""); err != nil || got != nil {
+		t.Errorf("parseRepoOptions(\"\") = %v, %v, want nil, nil", got, err)
+	}
+	if _, err := parseRepoOptions("{"); err == nil {
+		t.Error("expected error for invalid JSON")
+	}
+	if _, err := parseRepoOptions(`{"github.com/foo/bar": {"TagPattern": "v*.*"}}`); err == nil {
+		t.Error("expected error for invalid tag pattern")
+	}
+}
+
+func Test_parseUserAgentOverrides(t *testing.T) {
+	got, err := parseUserAgentOverrides(`{"https://github.com": "Sourcegraph"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"https://github.com": "Sourcegraph"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("parseUserAgentOverrides() = %v, want %v", got, want)
+	}
+
+	if got, err := parseUserAgentOverrides(""); err != nil || got != nil {
+		t.Errorf("parseUserAgentOverrides(\"\") = %v, %v, want nil, nil", got, err)
+	}
+	for _, s := range []string{"{", `{"github.com": "Sourcegraph"}`, `{"https://github.com": ""}`} {
+		if _, err := parseUserAgentOverrides(s); err == nil {
+			t.Errorf("expected error for %s", s)
+		}
+	}
+}
+
+func Test_validateHooksDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := validateHooksDir(""); err != nil || got != "" {
+		t.Errorf("validateHooksDir(\"\") = %q, %v, want empty", got, err)
+	}
+	if got, err := validateHooksDir(dir); err != nil || got != dir {
+		t.Errorf("validateHooksDir(%q) = %q, %v, want %q", dir, got, err, dir)
+	}
+	for _, d := range []string{file, filepath.Join(dir, "missing")} {
+		if _, err := validateHooksDir(d); err == nil {
+			t.Errorf("validateHooksDir(%q): expected error", d)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log15 "gopkg.in/inconshreveable/log15.v2"
+)
+
+// States of a hostBreaker.
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+// errBreakerOpen is returned instead of fetching from a host whose breaker
+// is open.
+type errBreakerOpen struct {
+	host  string
+	until time.Time
+}
+
+func (e *errBreakerOpen) Error() string {
+	return fmt.Sprintf("not fetching from %s after repeated network failures, retrying after %s", e.host, e.until.Format(time.RFC3339))
+}
+
+// hostBreakers is a circuit breaker per code host, so an outage of a host
+// makes fetches from it fail fast instead of piling up. The zero value is
+// ready to use.
+//
+// A breaker opens after threshold consecutive network failures. While open,
+// fetches fail without contacting the host. After cooldown the breaker is
+// half-open and lets a single fetch through: the breaker closes if it
+// reaches the host and opens again otherwise.
+type hostBreakers struct {
+	mu    sync.Mutex
+	hosts map[string]*hostBreaker
+}
+
+type hostBreaker struct {
+	state    string
+	failures int       // consecutive network failures while closed
+	until    time.Time // end of the cooldown while open
+}
+
+// allow returns an error if fetches from host must fail fast. Otherwise the
+// caller must report the outcome of its fetch to done.
+func (b *hostBreakers) allow(host string, threshold int, cooldown time.Duration, now time.Time) error {
+	if threshold <= 0 || host == "" {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	hb := b.hosts[host]
+	if hb == nil {
+		return nil
+	}
+	switch hb.state {
+	case breakerOpen:
+		if now.Before(hb.until) {
+			return &errBreakerOpen{host: host, until: hb.until}
+		}
+		hb.state = breakerHalfOpen
+		log15.Info("circuit breaker half-open", "host", host)
+		breakerStateChanges.WithLabelValues(breakerHalfOpen).Inc()
+		return nil
+	case breakerHalfOpen:
+		// Another fetch is testing whether the host recovered.
+		return &errBreakerOpen{host: host, until: now.Add(cooldown)}
+	}
+	return nil
+}
+
+// done records the outcome of a fetch from host which allow let through.
+// category is the classifyFetchError category of a failed fetch, or empty
+// if the fetch succeeded. Only network failures count against the host:
+// other failures, e.g. of authentication, show it is reachable.
+func (b *hostBreakers) done(host string, threshold int, cooldown time.Duration, category string, now time.Time) {
+	if threshold <= 0 || host == "" {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	hb := b.hosts[host]
+	if category != fetchErrorNetwork {
+		if hb != nil {
+			if hb.state != breakerClosed {
+				log15.Info("circuit breaker closed", "host", host)
+				breakerStateChanges.WithLabelValues(breakerClosed).Inc()
+			}
+			delete(b.hosts, host)
+		}
+		return
+	}
+
+	if hb == nil {
+		if b.hosts == nil {
+			b.hosts = make(map[string]*hostBreaker)
+		}
+		hb = &hostBreaker{state: breakerClosed}
+		b.hosts[host] = hb
+	}
+	hb.failures++
+	if hb.state == breakerHalfOpen || hb.failures >= threshold {
+		hb.state = breakerOpen
+		hb.until = now.Add(cooldown)
+		log15.Warn("circuit breaker open", "host", host, "failures", hb.failures, "until", hb.until)
+		breakerStateChanges.WithLabelValues(breakerOpen).Inc()
+	}
+}
+
+// state returns the state of the breaker of host.
+func (b *hostBreakers) state(host string) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if hb := b.hosts[host]; hb != nil {
+		return hb.state
+	}
+	return breakerClosed
+}
+
+// allowFetch returns an error if fetches from url must fail fast because the
+// breaker of its host is open. Otherwise the outcome of the fetch must be
+// reported to fetchDone.
+func (s *Server) allowFetch(url string) error {
+	return s.fetchBreakers.allow(fetchHost(url), s.FetchBreakerThreshold, s.FetchBreakerCooldown, time.Now())
+}
+
+// fetchDone reports the outcome of a fetch from url which allowFetch let
+// through.
+func (s *Server) fetchDone(url string, output []byte, err error) {
+	var category string
+	if err != nil {
+		category = classifyFetchError(output)
+	}
+	s.fetchBreakers.done(fetchHost(url), s.FetchBreakerThreshold, s.FetchBreakerCooldown, category, time.Now())
+}
+
+// fetchHost returns the host fetches from url are counted against. It is
+// empty if url cannot be parsed.
+func fetchHost(url string) string {
+	_, host, _, _, err := splitRemoteURL(url)
+	if err != nil {
+		return ""
+	}
+	return host
+}
+
+var breakerStateChanges = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "src",
+	Subsystem: "gitserver",
+	Name:      "fetch_breaker_state_changes_total",
+	Help:      "Number of times a per host fetch circuit breaker changed to a state.",
+}, []string{"state"})
+
+func init() {
+	prometheus.MustRegister(breakerStateChanges)
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHostBreakers(t *testing.T) {
+	const (
+		host      = "github.com"
+		threshold = 3
+		cooldown  = time.Minute
+	)
+	now := time.Date(2019, 10, 1, 0, 0, 0, 0, time.UTC)
+
+	var b hostBreakers
+	allow := func() error { return b.allow(host, threshold, cooldown, now) }
+	done := func(category string) { b.done(host, threshold, cooldown, category, now) }
+	assertState := func(want string) {
+		t.Helper()
+		if got := b.state(host); got != want {
+			t.Fatalf("got state %q, want %q", got, want)
+		}
+	}
+
+	// Failures which show the host is reachable don't count.
+	for i := 0; i < 2*threshold; i++ {
+		if err := allow(); err != nil {
+			t.Fatal(err)
+		}
+		done(fetchErrorUnauthorized)
+	}
+	assertState(breakerClosed)
+
+	// A success resets the consecutive failures.
+	for _, category := range []string{fetchErrorNetwork, fetchErrorNetwork, "", fetchErrorNetwork, fetchErrorNetwork} {
+		if err := allow(); err != nil {
+			t.Fatal(err)
+		}
+		done(category)
+	}
+	assertState(breakerClosed)
+
+	done(fetchErrorNetwork)
+	assertState(breakerOpen)
+	if err := allow(); err == nil {
+		t.Fatal("expected fetches to fail fast while open")
+	}
+	if err := b.allow("gitlab.com", threshold, cooldown, now); err != nil {
+		t.Fatalf("other hosts must not be affected: %s", err)
+	}
+
+	// After the cooldown a single fetch tests the host. A network failure
+	// opens the breaker again.
+	now = now.Add(cooldown)
+	if err := allow(); err != nil {
+		t.Fatal(err)
+	}
+	assertState(breakerHalfOpen)
+	if err := allow(); err == nil {
+		t.Fatal("expected only a single fetch while half-open")
+	}
+	done(fetchErrorNetwork)
+	assertState(breakerOpen)
+	now = now.Add(cooldown / 2)
+	if err := allow(); err == nil {
+		t.Fatal("expected fetches to fail fast during the new cooldown")
+	}
+
+	// A successful test closes the breaker.
+	now = now.Add(cooldown / 2)
+	if err := allow(); err != nil {
+		t.Fatal(err)
+	}
+	assertState(breakerHalfOpen)
+	done("")
+	assertState(breakerClosed)
+	if err := allow(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHostBreakers_disabled(t *testing.T) {
+	var b hostBreakers
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		if err := b.allow("github.com", 0, time.Minute, now); err != nil {
+			t.Fatal(err)
+		}
+		b.done("github.com", 0, time.Minute, fetchErrorNetwork, now)
+	}
+}
+
+func TestFetchHost(t *testing.T) {
+	for url, want := range map[string]string{
+		"https://token@github.com/foo/bar": "github.com",
+		"git@github.com:foo/bar.git":       "github.com",
+		"ssh://git@example.com:2222/foo":   "example.com",
+		"/some/local/path":                 "",
+	} {
+		if got := fetchHost(url); got != want {
+			t.Errorf("fetchHost(%q) = %q, want %q", url, got, want)
+		}
+	}
+}
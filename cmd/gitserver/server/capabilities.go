@@ -0,0 +1,42 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/sourcegraph/sourcegraph/internal/gitserver/protocol"
+	log15 "gopkg.in/inconshreveable/log15.v2"
+)
+
+// handleCapabilities reports the git version and the optional features
+// enabled on this gitserver.
+func (s *Server) handleCapabilities(w http.ResponseWriter, r *http.Request) {
+	if err := json.NewEncoder(w).Encode(s.capabilities()); err != nil {
+		log15.Error("failed to encode response", "error", err)
+	}
+}
+
+func (s *Server) capabilities() protocol.CapabilitiesResponse {
+	var resp protocol.CapabilitiesResponse
+	if major, minor, err := gitVersion(); err == nil {
+		resp.GitVersion = fmt.Sprintf("%d.%d", major, minor)
+	}
+
+	var sparseCheckout, maxFetchSize bool
+	for _, opts := range s.RepoOptions {
+		sparseCheckout = sparseCheckout || len(opts.SparseCheckout) > 0
+		maxFetchSize = maxFetchSize || opts.MaxFetchSize > 0
+	}
+	resp.Features = map[string]bool{
+		"workTree":             s.CloneWorkTree,
+		"sparseCheckout":       s.CloneWorkTree && sparseCheckout,
+		"fetchQuarantine":      len(s.FetchValidators) > 0 || s.MaxFetchSize > 0 || maxFetchSize,
+		"negotiationSkipping":  s.FetchNegotiationSkipping && gitVersionAtLeast(2, 19),
+		"hostResolveOverrides": len(s.HostResolveOverrides) > 0 && gitVersionAtLeast(2, 37),
+		"fetchBreaker":         s.FetchBreakerThreshold > 0,
+		"postFetchCommand":     s.PostFetchCommand != "",
+		"gzipResponses":        s.GzipResponses,
+	}
+	return resp
+}
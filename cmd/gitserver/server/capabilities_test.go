@@ -0,0 +1,68 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/sourcegraph/sourcegraph/internal/api"
+	"github.com/sourcegraph/sourcegraph/internal/gitserver/protocol"
+)
+
+func TestServer_handleCapabilities(t *testing.T) {
+	defer func(orig func() (int, int, error)) { gitVersion = orig }(gitVersion)
+	gitVersion = func() (int, int, error) { return 2, 24, nil }
+
+	reposDir, cleanup := tmpDir(t)
+	defer cleanup()
+	s := &Server{
+		ReposDir:                 reposDir,
+		CloneWorkTree:            true,
+		RepoOptions:              map[api.RepoName]RepoOptions{"example.com/foo/bar": {SparseCheckout: []string{"/docs/"}}},
+		FetchNegotiationSkipping: true,
+		HostResolveOverrides:     map[string]string{"github.com": "10.0.0.1"},
+		MaxFetchSize:             1 << 30,
+	}
+	h := s.Handler()
+	capabilities := func() protocol.CapabilitiesResponse {
+		t.Helper()
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest("GET", "/capabilities", nil))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("got status %d: %s", rr.Code, rr.Body.String())
+		}
+		var resp protocol.CapabilitiesResponse
+		if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	want := protocol.CapabilitiesResponse{
+		GitVersion: "2.24",
+		Features: map[string]bool{
+			"workTree":             true,
+			"sparseCheckout":       true,
+			"fetchQuarantine":      true,
+			"negotiationSkipping":  true,
+			"hostResolveOverrides": false, // requires git 2.37
+			"fetchBreaker":         false,
+			"postFetchCommand":     false,
+			"gzipResponses":        false,
+		},
+	}
+	if got := capabilities(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// Features which depend on the git version are disabled if it is
+	// unknown.
+	gitVersion = func() (int, int, error) { return 0, 0, errors.New("no git") }
+	got := capabilities()
+	if got.GitVersion != "" || got.Features["negotiationSkipping"] {
+		t.Errorf("got %+v without a git version", got)
+	}
+}
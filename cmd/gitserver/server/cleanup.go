@@ -16,6 +16,7 @@ import (
 	"time"
 
 	"github.com/hashicorp/go-multierror"
+	"github.com/karrick/godirwalk"
 	"github.com/pkg/errors"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -178,26 +179,7 @@ func (s *Server) cleanupRepos() {
 	// cheaper and faster to just reclone the repository.
 	cleanups = append(cleanups, cleanupFn{"maybe reclone", maybeReclone})
 
-	err := filepath.Walk(s.ReposDir, func(dir string, fi os.FileInfo, fileErr error) error {
-		if fileErr != nil {
-			return nil
-		}
-
-		if s.ignorePath(dir) {
-			if fi.IsDir() {
-				return filepath.SkipDir
-			}
-			return nil
-		}
-
-		// Look for $GIT_DIR
-		if !fi.IsDir() || fi.Name() != ".git" {
-			return nil
-		}
-
-		// We are sure this is a GIT_DIR after the above check
-		gitDir := GitDir(dir)
-
+	err := s.walkGitDirs(context.Background(), s.ReposDir, false, func(gitDir GitDir) error {
 		for _, cfn := range cleanups {
 			done, err := cfn.Do(gitDir)
 			if err != nil {
@@ -207,7 +189,7 @@ func (s *Server) cleanupRepos() {
 				break
 			}
 		}
-		return filepath.SkipDir
+		return nil
 	})
 	if err != nil {
 		log15.Error("cleanup: error iterating over repositories", "error", err)
@@ -357,8 +339,10 @@ func (s *Server) freeUpSpace(howManyBytesToFree int64) error {
 		return dirModTimes[gitDirs[i]].Before(dirModTimes[gitDirs[j]])
 	})
 
-	// Remove repos until howManyBytesToFree is met or exceeded.
-	var spaceFreed int64
+	// Remove repos until howManyBytesToFree is met or exceeded. With a grace
+	// period, repos which are scheduled for removal but not yet removed count
+	// as pending, so we don't schedule more repos than needed.
+	var spaceFreed, spacePending int64
 	mountPoint, err := findMountPoint(s.ReposDir)
 	if err != nil {
 		return errors.Wrap(err, "finding mount point")
@@ -367,14 +351,33 @@ func (s *Server) freeUpSpace(howManyBytesToFree int64) error {
 	if err != nil {
 		return errors.Wrap(err, "getting disk size")
 	}
-	for _, d := range gitDirs {
-		if spaceFreed >= howManyBytesToFree {
+	for i, d := range gitDirs {
+		if spaceFreed+spacePending >= howManyBytesToFree {
+			// Repos scheduled by an earlier run are no longer needed to free
+			// up space.
+			if s.EvictionGracePeriod > 0 {
+				for _, d := range gitDirs[i:] {
+					if err := clearEvictionMarker(d); err != nil {
+						log15.Warn("cleanup: failed to cancel removal of repo", "repo", d, "error", err)
+					}
+				}
+			}
 			return nil
 		}
-		delta, err := dirSize(string(d))
+		delta, err := s.repoSize(d)
 		if err != nil {
 			return errors.Wrapf(err, "computing size of directory %s", d)
 		}
+		if s.EvictionGracePeriod > 0 {
+			remove, err := s.evictionGracePeriodOver(d)
+			if err != nil {
+				return errors.Wrap(err, "scheduling repo for removal")
+			}
+			if !remove {
+				spacePending += delta
+				continue
+			}
+		}
 		if err := s.removeRepoDirectory(d); err != nil {
 			return errors.Wrap(err, "removing repo directory")
 		}
@@ -397,12 +400,60 @@ func (s *Server) freeUpSpace(howManyBytesToFree int64) error {
 	}
 
 	// Check.
-	if spaceFreed < howManyBytesToFree {
-		return fmt.Errorf("only freed %d bytes, wanted to free %d", spaceFreed, howManyBytesToFree)
+	if spaceFreed+spacePending < howManyBytesToFree {
+		return fmt.Errorf("only freed %d bytes, wanted to free %d", spaceFreed+spacePending, howManyBytesToFree)
 	}
 	return nil
 }
 
+// evictionMarkerFile is the file in a GIT_DIR whose mtime records when
+// freeUpSpace scheduled the repo for removal. See
+// Server.EvictionGracePeriod.
+const evictionMarkerFile = "sg_evict"
+
+// evictionGracePeriodOver reports whether d was scheduled for removal at
+// least s.EvictionGracePeriod ago. If d is not scheduled yet, it is scheduled
+// now.
+func (s *Server) evictionGracePeriodOver(d GitDir) (bool, error) {
+	fi, err := os.Stat(d.Path(evictionMarkerFile))
+	if err == nil {
+		return time.Since(fi.ModTime()) >= s.EvictionGracePeriod, nil
+	}
+	if !os.IsNotExist(err) {
+		return false, err
+	}
+	if err := ioutil.WriteFile(d.Path(evictionMarkerFile), nil, 0600); err != nil {
+		return false, err
+	}
+	log15.Info("cleanup: scheduled least recently used repo for removal", "repo", d, "grace period", s.EvictionGracePeriod)
+	return false, nil
+}
+
+func clearEvictionMarker(d GitDir) error {
+	err := os.Remove(d.Path(evictionMarkerFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// cancelEviction cancels a scheduled removal of d because it is being
+// accessed. It also marks d as recently used, so it is not the next
+// candidate for removal.
+func (s *Server) cancelEviction(d GitDir) {
+	if s.EvictionGracePeriod == 0 {
+		return
+	}
+	if err := os.Remove(d.Path(evictionMarkerFile)); err != nil {
+		return
+	}
+	now := time.Now()
+	if err := os.Chtimes(d.Path("HEAD"), now, now); err != nil {
+		log15.Warn("failed to update modification time of repo", "repo", d, "error", err)
+	}
+	log15.Info("cancelled removal of repo since it was accessed", "repo", d)
+}
+
 func gitDirModTime(d GitDir) (time.Time, error) {
 	head, err := os.Stat(d.Path("HEAD"))
 	if err != nil {
@@ -411,23 +462,91 @@ func gitDirModTime(d GitDir) (time.Time, error) {
 	return head.ModTime(), nil
 }
 
-func (s *Server) findGitDirs() ([]GitDir, error) {
-	var dirs []GitDir
-	err := filepath.Walk(s.ReposDir, func(path string, fi os.FileInfo, fileErr error) error {
-		if fileErr != nil {
-			return nil
-		}
-		if s.ignorePath(path) {
-			if fi.IsDir() {
+// walkGitDirs calls fn for the GIT_DIR of every repository in root, which is
+// s.ReposDir or s.PreviousReposDir. It skips temporary directories like
+// ignorePath.
+//
+// Work trees are not searched for GIT_DIRs, only their directories are
+// walked: they may hold the directories of nested repositories, e.g. of
+// gitlab.com/foo/bar in the work tree of gitlab.com/foo. If oldStyle is
+// set, fn is also called for repositories with the old-style layout, whose
+// GIT_DIR is ${root}/${name}. They are only looked for outside of work trees.
+func (s *Server) walkGitDirs(ctx context.Context, root string, oldStyle bool, fn func(dir GitDir) error) error {
+	// The work trees containing the current path, innermost last.
+	var workTrees []string
+	return godirwalk.Walk(root, &godirwalk.Options{
+		Callback: func(path string, de *godirwalk.Dirent) error {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			if s.ignorePathIn(root, path) {
+				if de.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
+			// We only care about directories. GIT_DIRs are handled when
+			// visiting their parent.
+			if !de.IsDir() {
+				return nil
+			}
+			if de.Name() == ".git" {
 				return filepath.SkipDir
 			}
-			return nil
-		}
-		if !fi.IsDir() || fi.Name() != ".git" {
-			return nil
-		}
-		dirs = append(dirs, GitDir(path))
-		return filepath.SkipDir
+
+			for len(workTrees) > 0 && !strings.HasPrefix(path, workTrees[len(workTrees)-1]+string(filepath.Separator)) {
+				workTrees = workTrees[:len(workTrees)-1]
+			}
+
+			// New style git directory layout
+			gitDir := filepath.Join(path, ".git")
+			if fi, err := os.Stat(gitDir); err == nil && fi.IsDir() {
+				if err := fn(GitDir(gitDir)); err != nil {
+					return err
+				}
+				if s.CloneWorkTree {
+					workTrees = append(workTrees, path)
+				}
+				// Keep recursing for nested repositories.
+				return nil
+			}
+
+			// Directories of work trees are never repositories themselves,
+			// even if they contain a file named HEAD.
+			if !oldStyle || len(workTrees) > 0 {
+				return nil
+			}
+
+			// For old-style directory layouts we need to do an extra extra
+			// stat to check if this is a repo.
+			if _, err := os.Stat(filepath.Join(path, "HEAD")); os.IsNotExist(err) {
+				// HEAD doesn't exist, so keep recursing
+				return nil
+			} else if err != nil {
+				return err
+			}
+
+			// path is an old style git repo since it contains HEAD
+			if err := fn(GitDir(path)); err != nil {
+				return err
+			}
+			return filepath.SkipDir
+		},
+		ErrorCallback: func(path string, err error) godirwalk.ErrorAction {
+			// Ignore errors and simply continue with other nodes
+			return godirwalk.SkipNode
+		},
+		Unsorted: true,
+	})
+}
+
+func (s *Server) findGitDirs() ([]GitDir, error) {
+	var dirs []GitDir
+	err := s.walkGitDirs(context.Background(), s.ReposDir, false, func(dir GitDir) error {
+		dirs = append(dirs, dir)
+		return nil
 	})
 	if err != nil {
 		return nil, errors.Wrap(err, "findGitDirs")
@@ -461,30 +580,16 @@ func dirSize(d string) (int64, error) {
 // the directory.
 //
 // Additionally it removes parent empty directories up until s.ReposDir.
-func (s *Server) removeRepoDirectory(gitDir GitDir) error {
-	dir := string(gitDir)
-
-	// Rename out of the location so we can atomically stop using the repo.
-	tmp, err := s.tempDir("delete-repo")
-	if err != nil {
-		return err
-	}
-	defer os.RemoveAll(tmp)
-	if err := renameAndSync(dir, filepath.Join(tmp, "repo")); err != nil {
-		return err
-	}
-
-	// Everything after this point is just cleanup, so any error that occurs
-	// should not be returned, just logged.
-
-	// Cleanup empty parent directories. We just attempt to remove and if we
-	// have a failure we assume it's due to the directory having other
-	// children. If we checked first we could race with someone else adding a
-	// new clone.
+// removeEmptyParents removes the parent directories of dir in ReposDir
+// which are empty.
+func (s *Server) removeEmptyParents(dir string) {
+	// We just attempt to remove and if we have a failure we assume it's due
+	// to the directory having other children. If we checked first we could
+	// race with someone else adding a new clone.
 	rootInfo, err := os.Stat(s.ReposDir)
 	if err != nil {
 		log15.Warn("Failed to stat ReposDir", "error", err)
-		return nil
+		return
 	}
 	current := dir
 	for {
@@ -502,7 +607,7 @@ func (s *Server) removeRepoDirectory(gitDir GitDir) error {
 		}
 		if err != nil {
 			log15.Warn("failed to stat parent directory", "dir", current, "error", err)
-			return nil
+			return
 		}
 		if os.SameFile(rootInfo, info) {
 			// Stop, we are at the parent.
@@ -514,6 +619,32 @@ func (s *Server) removeRepoDirectory(gitDir GitDir) error {
 			break
 		}
 	}
+}
+
+func (s *Server) removeRepoDirectory(gitDir GitDir) error {
+	dir := string(gitDir)
+
+	// Rename out of the location so we can atomically stop using the repo.
+	tmp, err := s.tempDirFor(gitDir, "delete-repo")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	if err := renameAndSync(dir, filepath.Join(tmp, "repo")); err != nil {
+		return err
+	}
+
+	// Everything after this point is just cleanup, so any error that occurs
+	// should not be returned, just logged.
+
+	if workTree, ok := s.workTree(gitDir); ok {
+		if err := removeWorkTree(workTree); err != nil {
+			log15.Warn("failed to remove work tree", "dir", workTree, "error", err)
+		}
+	}
+
+	// Cleanup empty parent directories.
+	s.removeEmptyParents(dir)
 
 	// Delete the atomically renamed dir. We do this last since if it fails we
 	// will rely on a janitor job to clean up for us.
@@ -553,18 +684,34 @@ func (s *Server) cleanTmpFiles(dir GitDir) {
 }
 
 // SetupAndClearTmp sets up the the tempdir for ReposDir as well as clearing it
-// out. It returns the temporary directory location.
+// out. It returns the temporary directory location. The temporary
+// directories of StorageCloneLimits are cleared as well.
 func (s *Server) SetupAndClearTmp() (string, error) {
+	dir, err := clearTmp(s.ReposDir, true)
+	if err != nil {
+		return "", err
+	}
+	for d := range s.StorageCloneLimits {
+		if _, err := clearTmp(filepath.Join(s.ReposDir, d), false); err != nil {
+			return "", err
+		}
+	}
+	return dir, nil
+}
+
+// clearTmp sets up and clears the tempdir in parent. If legacy is true,
+// tmp- directories of old versions are removed as well.
+func clearTmp(parent string, legacy bool) (string, error) {
 	// Additionally we create directories with the prefix .tmp-old which are
 	// asynchronously removed. We do not remove in place since it may be a
-	// slow operation to block on. Our tmp dir will be ${s.ReposDir}/.tmp
-	dir := filepath.Join(s.ReposDir, tempDirName) // .tmp
+	// slow operation to block on. Our tmp dir will be ${parent}/.tmp
+	dir := filepath.Join(parent, tempDirName) // .tmp
 	oldPrefix := tempDirName + "-old"
 	if _, err := os.Stat(dir); err == nil {
 		// Rename the current tmp file so we can asynchronously remove it. Use
 		// a consistent pattern so if we get interrupted, we can clean it
 		// another time.
-		oldTmp, err := ioutil.TempDir(s.ReposDir, oldPrefix)
+		oldTmp, err := ioutil.TempDir(parent, oldPrefix)
 		if err != nil {
 			return "", err
 		}
@@ -580,7 +727,7 @@ func (s *Server) SetupAndClearTmp() (string, error) {
 	}
 
 	// Asynchronously remove old temporary directories
-	files, err := ioutil.ReadDir(s.ReposDir)
+	files, err := ioutil.ReadDir(parent)
 	if err != nil {
 		log15.Error("failed to do tmp cleanup", "error", err)
 	} else {
@@ -588,14 +735,14 @@ func (s *Server) SetupAndClearTmp() (string, error) {
 			// Remove older .tmp directories as well as our older tmp-
 			// directories we would place into ReposDir. In September 2018 we
 			// can remove support for removing tmp- directories.
-			if !strings.HasPrefix(f.Name(), oldPrefix) && !strings.HasPrefix(f.Name(), "tmp-") {
+			if !strings.HasPrefix(f.Name(), oldPrefix) && !(legacy && strings.HasPrefix(f.Name(), "tmp-")) {
 				continue
 			}
 			go func(path string) {
 				if err := os.RemoveAll(path); err != nil {
 					log15.Error("cleanup: failed to remove old temporary directory", "path", path, "error", err)
 				}
-			}(filepath.Join(s.ReposDir, f.Name()))
+			}(filepath.Join(parent, f.Name()))
 		}
 	}
 
@@ -538,6 +538,106 @@ func TestFreeUpSpace(t *testing.T) {
 			t.Errorf("repo dir size is %d, want no more than %d", rds, wantSize)
 		}
 	})
+	t.Run("grace period", func(t *testing.T) {
+		rd, err := ioutil.TempDir("", "freeUpSpace")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(rd)
+		r1 := GitDir(filepath.Join(rd, "repo1", ".git"))
+		r2 := GitDir(filepath.Join(rd, "repo2", ".git"))
+		for i, d := range []GitDir{r1, r2} {
+			if err := makeFakeRepo(filepath.Dir(string(d)), 1000); err != nil {
+				t.Fatal(err)
+			}
+			mtime := time.Now().Add(time.Duration(i-10) * time.Hour)
+			if err := os.Chtimes(d.Path("HEAD"), mtime, mtime); err != nil {
+				t.Fatal(err)
+			}
+		}
+		scheduled := func(d GitDir) bool {
+			_, err := os.Stat(d.Path(evictionMarkerFile))
+			return err == nil
+		}
+		backdateMarker := func(d GitDir) {
+			mtime := time.Now().Add(-2 * time.Hour)
+			if err := os.Chtimes(d.Path(evictionMarkerFile), mtime, mtime); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		s := Server{
+			ReposDir:            rd,
+			DiskSizer:           &fakeDiskSizer{},
+			EvictionGracePeriod: time.Hour,
+		}
+
+		// The oldest repo is only scheduled for removal.
+		if err := s.freeUpSpace(1000); err != nil {
+			t.Fatal(err)
+		}
+		if !scheduled(r1) || scheduled(r2) {
+			t.Fatalf("want only repo1 scheduled, got repo1=%v repo2=%v", scheduled(r1), scheduled(r2))
+		}
+		if err := s.freeUpSpace(1000); err != nil {
+			t.Fatal(err)
+		}
+		if !repoCloned(r1) {
+			t.Fatal("repo1 removed during grace period")
+		}
+
+		// Access during the grace period cancels the removal and makes
+		// repo2 the least recently used.
+		backdateMarker(r1)
+		s.cancelEviction(r1)
+		if scheduled(r1) {
+			t.Fatal("access did not cancel removal of repo1")
+		}
+		if err := s.freeUpSpace(1000); err != nil {
+			t.Fatal(err)
+		}
+		if scheduled(r1) || !scheduled(r2) {
+			t.Fatalf("want only repo2 scheduled, got repo1=%v repo2=%v", scheduled(r1), scheduled(r2))
+		}
+
+		// Untouched repos are removed after the grace period.
+		backdateMarker(r2)
+		if err := s.freeUpSpace(1000); err != nil {
+			t.Fatal(err)
+		}
+		if repoCloned(r2) {
+			t.Error("repo2 not removed after grace period")
+		}
+		if !repoCloned(r1) || scheduled(r1) {
+			t.Error("repo1 should not be affected")
+		}
+	})
+	t.Run("grace period: schedule is cancelled once space is free", func(t *testing.T) {
+		rd, err := ioutil.TempDir("", "freeUpSpace")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(rd)
+		if err := makeFakeRepo(filepath.Join(rd, "repo1"), 1000); err != nil {
+			t.Fatal(err)
+		}
+		d := GitDir(filepath.Join(rd, "repo1", ".git"))
+
+		s := Server{
+			ReposDir:            rd,
+			DiskSizer:           &fakeDiskSizer{},
+			EvictionGracePeriod: time.Hour,
+		}
+		if err := s.freeUpSpace(1000); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.freeUpSpace(0); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(d.Path(evictionMarkerFile)); !os.IsNotExist(err) {
+			t.Errorf("expected removal of repo1 to be cancelled, got %v", err)
+		}
+	})
 }
 
 func makeFakeRepo(d string, sizeBytes int) error {
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"context"
+	"os/exec"
+
+	"github.com/pkg/errors"
+	"github.com/sourcegraph/sourcegraph/internal/api"
+	"github.com/sourcegraph/sourcegraph/internal/gitserver/protocol"
+	"github.com/sourcegraph/sourcegraph/internal/vcs/git"
+	log15 "gopkg.in/inconshreveable/log15.v2"
+)
+
+// fetchCommit ensures the cloned repo contains commit. It only fetches
+// commit, which is much cheaper than a full update, if the remote allows
+// fetching unadvertised objects (e.g. uploadpack.allowReachableSHA1InWant
+// or protocol version 2). Otherwise it falls back to a full update.
+//
+// The commit is not added to any ref, so it is only kept by gc if it is
+// reachable from a ref after the next update.
+func (s *Server) fetchCommit(ctx context.Context, repo api.RepoName, url, commit string) error {
+	if !git.IsAbsoluteRevision(commit) {
+		return errors.Errorf("invalid commit %q", commit)
+	}
+	repo = protocol.NormalizeRepo(repo)
+	dir := s.dir(repo)
+	if commitExists(ctx, dir, commit) {
+		return nil
+	}
+
+	err := s.fetchCommitBySHA(ctx, repo, dir, url, commit)
+	if err == nil && commitExists(ctx, dir, commit) {
+		return nil
+	}
+	log15.Info("fetching commit failed, falling back to a full update", "repo", repo, "commit", commit, "error", err)
+	if err := s.doRepoUpdate(ctx, repo, url); err != nil {
+		return err
+	}
+	if !commitExists(ctx, dir, commit) {
+		return errors.Errorf("commit %s not found in %s", commit, repo)
+	}
+	return nil
+}
+
+// fetchCommitBySHA fetches commit from url into dir. It holds the update
+// lock of repo, so it does not run concurrently with updates.
+func (s *Server) fetchCommitBySHA(ctx context.Context, repo api.RepoName, dir GitDir, url, commit string) error {
+	return s.withRepoUpdateLock(repo, func(*locks) error {
+		ctx, cancel, err := s.acquireCloneLimiter(ctx, dir)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		if url == "" {
+			if url, err = repoRemoteURL(ctx, dir); err != nil || url == "" {
+				return errors.Wrap(err, "failed to determine Git remote URL")
+			}
+		}
+		if output, err := s.fetchFrom(ctx, repo, dir, url, []string{commit}); err != nil {
+			// 🚨 SECURITY: The error and output could include the remote url
+			// which may contain a sensitive token.
+			redactor := newURLRedactor(url)
+			return errors.Errorf("failed to fetch commit: %s: %s", redactor.redact(err.Error()), redactor.redact(string(output)))
+		}
+		return nil
+	})
+}
+
+// commitExists reports whether dir contains commit.
+func commitExists(ctx context.Context, dir GitDir, commit string) bool {
+	cmd := exec.CommandContext(ctx, "git", "cat-file", "-e", commit+"^{commit}")
+	cmd.Dir = string(dir)
+	return cmd.Run() == nil
+}
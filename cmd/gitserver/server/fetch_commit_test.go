@@ -0,0 +1,107 @@
+package server
+
+import (
+	"context"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/sourcegraph/sourcegraph/internal/api"
+	"github.com/sourcegraph/sourcegraph/internal/mutablelimiter"
+)
+
+func TestServer_fetchCommit(t *testing.T) {
+	testFetchCommit(t, true)
+}
+
+func TestServer_fetchCommit_fallback(t *testing.T) {
+	testFetchCommit(t, false)
+}
+
+// testFetchCommit fetches a commit which was added to the remote after
+// cloning. If bySHA is false the remote refuses to send it by SHA, so it is
+// fetched by a full update instead.
+func testFetchCommit(t *testing.T, bySHA bool) {
+	remote, cleanup1 := tmpDir(t)
+	defer cleanup1()
+	runCmd(t, remote, "git", "init", ".")
+	runCmd(t, remote, "git", "commit", "--allow-empty", "-m", "initial")
+
+	reposDir, cleanup2 := tmpDir(t)
+	defer cleanup2()
+	s := &Server{
+		ReposDir:         reposDir,
+		ctx:              context.Background(),
+		locker:           &RepositoryLocker{},
+		cloneLimiter:     mutablelimiter.New(1),
+		cloneableLimiter: mutablelimiter.New(1),
+		repoUpdateLocks:  make(map[api.RepoName]*locks),
+	}
+	repo := api.RepoName("example.com/foo/bar")
+	if _, err := s.cloneRepo(context.Background(), repo, remote, &cloneOptions{Block: true}); err != nil {
+		t.Fatal(err)
+	}
+	dir := s.dir(repo)
+
+	runCmd(t, remote, "git", "checkout", "-b", "feature")
+	runCmd(t, remote, "git", "commit", "--allow-empty", "-m", "feature")
+	commit := strings.TrimSpace(runCmd(t, remote, "git", "rev-parse", "HEAD"))
+
+	if !bySHA {
+		// Simulate a remote which does not allow fetching
+		// unadvertised objects.
+		runCommandMock = func(ctx context.Context, cmd *exec.Cmd) (int, error) {
+			if cmd.Args[len(cmd.Args)-1] == commit {
+				_, _ = cmd.Stderr.Write([]byte("error: Server does not allow request for unadvertised object " + commit + "\n"))
+				return 128, errors.New("exit status 128")
+			}
+			err := cmd.Run()
+			return cmd.ProcessState.ExitCode(), err
+		}
+		defer func() { runCommandMock = nil }()
+	}
+
+	if err := s.fetchCommit(context.Background(), repo, remote, commit); err != nil {
+		t.Fatal(err)
+	}
+	if !commitExists(context.Background(), dir, commit) {
+		t.Fatal("commit was not fetched")
+	}
+
+	// Only a full update fetches the new branch.
+	cmd := exec.Command("git", "rev-parse", "--verify", "--quiet", "refs/heads/feature")
+	cmd.Dir = string(dir)
+	if fetchedBranch := cmd.Run() == nil; fetchedBranch == bySHA {
+		t.Errorf("got fetched branch %v, want %v", fetchedBranch, !bySHA)
+	}
+}
+
+func TestServer_fetchCommit_invalid(t *testing.T) {
+	s := &Server{}
+	if err := s.fetchCommit(context.Background(), "example.com/foo/bar", "", "master"); err == nil {
+		t.Error("expected error for a commit which is not a SHA")
+	}
+}
+
+func TestServer_withRepoUpdateLock(t *testing.T) {
+	s := &Server{repoUpdateLocks: make(map[api.RepoName]*locks)}
+	repo := api.RepoName("example.com/foo/bar")
+
+	// Repacks are refused while the lock is held for a fetch.
+	err := s.withRepoUpdateLock(repo, func(*locks) error {
+		if _, ok := s.lockRepoUpdates(repo); ok {
+			t.Error("expected updates to be locked while fetching")
+		}
+		return errors.New("fetch failed")
+	})
+	if err == nil || err.Error() != "fetch failed" {
+		t.Fatalf("got error %v, want the error of fn", err)
+	}
+
+	unlock, ok := s.lockRepoUpdates(repo)
+	if !ok {
+		t.Fatal("expected updates to be unlocked after fetching")
+	}
+	unlock()
+}
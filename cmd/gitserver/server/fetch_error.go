@@ -0,0 +1,163 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sourcegraph/sourcegraph/internal/gitserver/protocol"
+)
+
+// fetchErrorFile is the file in a GIT_DIR recording the most recent fetch
+// failures. It is removed after a successful fetch.
+const fetchErrorFile = "sg_fetch_error"
+
+// fallbackRemoteFile is the file in a GIT_DIR recording the fallback remote
+// the last fetch succeeded from. It is removed after a successful fetch from
+// the primary remote.
+const fallbackRemoteFile = "sg_fallback_remote"
+
+// Categories returned by classifyFetchError.
+const (
+	fetchErrorNotFound     = "not-found"
+	fetchErrorUnauthorized = "unauthorized"
+	fetchErrorNetwork      = "network"
+	fetchErrorUnknown      = "unknown"
+)
+
+// fetchErrorPatterns maps substrings of git's output to an error category.
+// The first matching pattern wins.
+var fetchErrorPatterns = []struct {
+	pattern  string
+	category string
+}{
+	{"Authentication failed", fetchErrorUnauthorized},
+	{"Permission denied", fetchErrorUnauthorized},
+	{"The requested URL returned error: 401", fetchErrorUnauthorized},
+	{"The requested URL returned error: 403", fetchErrorUnauthorized},
+	{"could not read Username", fetchErrorUnauthorized},
+	{"not found", fetchErrorNotFound},
+	{"does not exist", fetchErrorNotFound},
+	{"does not appear to be a git repository", fetchErrorNotFound},
+	{"The requested URL returned error: 404", fetchErrorNotFound},
+	{"Could not resolve host", fetchErrorNetwork},
+	{"Connection timed out", fetchErrorNetwork},
+	{"Connection refused", fetchErrorNetwork},
+	{"Connection reset", fetchErrorNetwork},
+	{"Operation timed out", fetchErrorNetwork},
+	{"The remote end hung up unexpectedly", fetchErrorNetwork},
+	{"The requested URL returned error: 5", fetchErrorNetwork},
+}
+
+// classifyFetchError returns a coarse category for the output of a failed
+// git fetch or clone.
+func classifyFetchError(output []byte) string {
+	for _, p := range fetchErrorPatterns {
+		if bytes.Contains(output, []byte(p.pattern)) {
+			return p.category
+		}
+	}
+	return fetchErrorUnknown
+}
+
+// repoLastFetchError returns the most recent fetch failure recorded for
+// dir. It returns nil if the last fetch succeeded or no fetch failure has
+// been recorded.
+func repoLastFetchError(dir GitDir) (*protocol.FetchError, error) {
+	b, err := reposFS.ReadFile(dir.Path(fetchErrorFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var fe protocol.FetchError
+	if err := json.Unmarshal(b, &fe); err != nil {
+		return nil, errors.Wrapf(err, "invalid %s", fetchErrorFile)
+	}
+	return &fe, nil
+}
+
+// recordFetchError records a failed fetch of dir, incrementing the count of
+// consecutive failures. redactedOutput must not contain credentials.
+func recordFetchError(dir GitDir, redactedOutput []byte, now time.Time) error {
+	prev, err := repoLastFetchError(dir)
+	if err != nil {
+		// Start counting again rather than failing forever on a bad file.
+		prev = nil
+	}
+
+	message := bytes.TrimSpace(redactedOutput)
+	if len(message) > 1024 {
+		message = message[:1024]
+	}
+	fe := protocol.FetchError{
+		Category:            classifyFetchError(redactedOutput),
+		Message:             string(message),
+		Time:                now,
+		ConsecutiveFailures: 1,
+	}
+	if prev != nil {
+		fe.ConsecutiveFailures = prev.ConsecutiveFailures + 1
+	}
+
+	b, err := json.Marshal(&fe)
+	if err != nil {
+		return err
+	}
+	_, err = updateFileIfDifferent(dir.Path(fetchErrorFile), b)
+	return err
+}
+
+// clearFetchError resets the recorded fetch failures of dir after a
+// successful fetch.
+func clearFetchError(dir GitDir) error {
+	err := os.Remove(dir.Path(fetchErrorFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// shouldFallBack reports whether a fetch which failed with output and err
+// should be retried with a fallback remote. Only failures to reach the
+// repository are retried: credentials which are rejected by the primary
+// remote are not likely to be a problem of the primary remote.
+func shouldFallBack(output []byte, err error) bool {
+	if _, ok := err.(*errBreakerOpen); ok {
+		return true
+	}
+	switch classifyFetchError(output) {
+	case fetchErrorNetwork, fetchErrorNotFound:
+		return true
+	}
+	return false
+}
+
+// repoFallbackRemote returns the fallback remote the last fetch of dir
+// succeeded from, without credentials. It is empty if the last successful
+// fetch was from the primary remote.
+func repoFallbackRemote(dir GitDir) (string, error) {
+	b, err := reposFS.ReadFile(dir.Path(fallbackRemoteFile))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return string(bytes.TrimSpace(b)), err
+}
+
+// setFallbackRemote records that the last fetch of dir succeeded from the
+// fallback remote url. An empty url records a fetch from the primary remote.
+func setFallbackRemote(dir GitDir, url string) error {
+	if url == "" {
+		err := os.Remove(dir.Path(fallbackRemoteFile))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	// 🚨 SECURITY: The URL may contain a sensitive token.
+	_, err := updateFileIfDifferent(dir.Path(fallbackRemoteFile), []byte(withoutCredentials(url)+"\n"))
+	return err
+}
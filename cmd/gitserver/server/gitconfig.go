@@ -0,0 +1,260 @@
+package server
+
+import (
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sourcegraph/sourcegraph/internal/api"
+	"github.com/sourcegraph/sourcegraph/internal/gitserver/protocol"
+)
+
+// GitMemoryConfig bounds the memory git uses while packing objects. Clone
+// and fetch can trigger large repacks (directly or via gc --auto), which can
+// exceed container memory limits and get the process OOM-killed. Empty
+// fields leave git's defaults in place.
+type GitMemoryConfig struct {
+	// PackWindowMemory is passed as pack.windowMemory, e.g. "100m".
+	PackWindowMemory string
+
+	// PackSizeLimit is passed as pack.packSizeLimit, e.g. "2g".
+	PackSizeLimit string
+
+	// BigFileThreshold is passed as core.bigFileThreshold, e.g. "50m".
+	BigFileThreshold string
+}
+
+// merge returns c with the non-empty fields of o taking precedence.
+func (c GitMemoryConfig) merge(o GitMemoryConfig) GitMemoryConfig {
+	if o.PackWindowMemory != "" {
+		c.PackWindowMemory = o.PackWindowMemory
+	}
+	if o.PackSizeLimit != "" {
+		c.PackSizeLimit = o.PackSizeLimit
+	}
+	if o.BigFileThreshold != "" {
+		c.BigFileThreshold = o.BigFileThreshold
+	}
+	return c
+}
+
+func (c GitMemoryConfig) args() []string {
+	var args []string
+	if c.PackWindowMemory != "" {
+		args = append(args, "-c", "pack.windowMemory="+c.PackWindowMemory)
+	}
+	if c.PackSizeLimit != "" {
+		args = append(args, "-c", "pack.packSizeLimit="+c.PackSizeLimit)
+	}
+	if c.BigFileThreshold != "" {
+		args = append(args, "-c", "core.bigFileThreshold="+c.BigFileThreshold)
+	}
+	return args
+}
+
+// RepoOptions are per-repository overrides of the Server's git options. They
+// are used to tune known-problematic repositories without affecting the rest.
+type RepoOptions struct {
+	// Memory overrides the non-empty fields of Server.GitMemoryConfig.
+	Memory GitMemoryConfig
+
+	// TagPattern restricts the tags mirrored by fetches to those matching
+	// the glob, e.g. "v*". Tags which no longer exist upstream are pruned
+	// only if they match. The initial clone still mirrors all tags. It may
+	// contain at most one "*". Empty mirrors all tags.
+	TagPattern string
+
+	// RemoteScheme is RemoteSchemeSSH or RemoteSchemeHTTPS to rewrite the
+	// remote URL to that scheme when cloning and fetching. Over SSH the key
+	// of the host is used instead of the token in the URL. Empty uses the
+	// URL unchanged.
+	RemoteScheme string
+
+	// SparseCheckout restricts the work tree checked out if
+	// Server.CloneWorkTree is set to the paths matching these
+	// sparse-checkout patterns, e.g. "/docs/". Empty checks out all paths.
+	SparseCheckout []string
+
+	// Compression overrides Server.GitCompression.
+	Compression string
+
+	// MaxFetchSize overrides Server.MaxFetchSize if it is not zero.
+	MaxFetchSize int64
+
+	// FallbackURLs are mirrors of the repository, including credentials,
+	// which fetches try in order if the remote URL can't be reached or the
+	// repository is not found there. Other failures, e.g. of
+	// authentication, are not retried.
+	FallbackURLs []string
+}
+
+// Validate returns an error if o contains invalid options.
+func (o RepoOptions) Validate() error {
+	if p := o.TagPattern; strings.Count(p, "*") > 1 || strings.ContainsAny(p, ": \t\n^~?[\\") {
+		return errors.Errorf("invalid tag pattern %q", p)
+	}
+	switch o.RemoteScheme {
+	case "", RemoteSchemeSSH, RemoteSchemeHTTPS:
+	default:
+		return errors.Errorf("invalid remote scheme %q", o.RemoteScheme)
+	}
+	for _, u := range o.FallbackURLs {
+		if _, _, _, _, err := splitRemoteURL(u); err != nil {
+			// 🚨 SECURITY: The URL may contain a sensitive token.
+			return errors.Errorf("invalid fallback URL %q", withoutCredentials(u))
+		}
+	}
+	if err := validateCompression(o.Compression); err != nil {
+		return err
+	}
+	if o.MaxFetchSize < 0 {
+		return errors.Errorf("invalid max fetch size %d", o.MaxFetchSize)
+	}
+	for _, p := range o.SparseCheckout {
+		if strings.TrimSpace(p) == "" || strings.ContainsAny(p, "\r\n") {
+			return errors.Errorf("invalid sparse checkout pattern %q", p)
+		}
+	}
+	return nil
+}
+
+// validateCompression returns an error if level is neither empty nor a
+// zlib compression level accepted by git's core.compression.
+func validateCompression(level string) error {
+	if level == "" {
+		return nil
+	}
+	if n, err := strconv.Atoi(level); err != nil || n < -1 || n > 9 {
+		return errors.Errorf("invalid compression level %q, want -1 to 9", level)
+	}
+	return nil
+}
+
+// compressionArgs returns the "-c" arguments setting the compression level
+// for objects git writes for repo.
+func (s *Server) compressionArgs(repo api.RepoName) []string {
+	level := s.GitCompression
+	if l := s.repoOptions(repo).Compression; l != "" {
+		level = l
+	}
+	if level == "" {
+		return nil
+	}
+	return []string{"-c", "core.compression=" + level}
+}
+
+// repoOptions returns the RepoOptions configured for repo, if any.
+func (s *Server) repoOptions(repo api.RepoName) RepoOptions {
+	return s.RepoOptions[protocol.NormalizeRepo(repo)]
+}
+
+// remoteGitConfigArgs returns the "-c" arguments which should be passed to
+// git for commands which clone or fetch repo.
+func (s *Server) remoteGitConfigArgs(repo api.RepoName) []string {
+	opts := s.repoOptions(repo)
+	args := s.GitMemoryConfig.merge(opts.Memory).args()
+	args = append(args, s.compressionArgs(repo)...)
+	if s.GitHooksDir != "" {
+		args = append(args, "-c", "core.hooksPath="+s.GitHooksDir)
+	}
+	if s.GitUserAgent != "" {
+		args = append(args, "-c", "http.userAgent="+s.GitUserAgent)
+	}
+	prefixes := make([]string, 0, len(s.GitUserAgentOverrides))
+	for prefix := range s.GitUserAgentOverrides {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	for _, prefix := range prefixes {
+		args = append(args, "-c", "http."+prefix+".userAgent="+s.GitUserAgentOverrides[prefix])
+	}
+	return args
+}
+
+// fetchRefspecs returns the refspecs used when fetching repo.
+func (s *Server) fetchRefspecs(repo api.RepoName) []string {
+	tags := "*"
+	if p := s.repoOptions(repo).TagPattern; p != "" {
+		tags = p
+	}
+	return []string{
+		"+refs/heads/*:refs/heads/*",
+		"+refs/tags/" + tags + ":refs/tags/" + tags,
+		"+refs/pull/*:refs/pull/*",
+	}
+}
+
+// fetchArgs returns the arguments to git for fetching refspecs of repo from
+// url.
+func (s *Server) fetchArgs(repo api.RepoName, url string, refspecs []string) []string {
+	args := s.remoteGitConfigArgs(repo)
+	var flags []string
+	if s.FetchNegotiationSkipping && gitVersionAtLeast(2, 19) {
+		// Only advertise branches as negotiation tips. Large repos can have
+		// tens of thousands of tags and pull request refs, which otherwise
+		// each cost negotiation round-trips.
+		args = append(args, "-c", "fetch.negotiationAlgorithm=skipping")
+		flags = append(flags, "--negotiation-tip=refs/heads/*")
+	}
+	// Progress is only reported to terminals unless asked for. It is parsed
+	// to record how much each fetch transferred.
+	args = append(args, "fetch", "--prune", "--progress")
+	args = append(args, flags...)
+	args = append(args, url)
+	return append(args, refspecs...)
+}
+
+// gitVersionAtLeast reports whether the installed git is at least version
+// major.minor. It returns false if the version can't be determined.
+func gitVersionAtLeast(major, minor int) bool {
+	gotMajor, gotMinor, err := gitVersion()
+	if err != nil {
+		return false
+	}
+	return gotMajor > major || (gotMajor == major && gotMinor >= minor)
+}
+
+var (
+	gitVersionOnce  sync.Once
+	gitVersionMajor int
+	gitVersionMinor int
+	gitVersionErr   error
+)
+
+// gitVersion returns the major and minor version of the installed git. The
+// result is cached.
+var gitVersion = func() (major, minor int, err error) {
+	gitVersionOnce.Do(func() {
+		var out []byte
+		out, gitVersionErr = exec.Command("git", "version").Output()
+		if gitVersionErr != nil {
+			return
+		}
+		gitVersionMajor, gitVersionMinor, gitVersionErr = parseGitVersion(string(out))
+	})
+	return gitVersionMajor, gitVersionMinor, gitVersionErr
+}
+
+// parseGitVersion parses the major and minor version from the output of
+// git version, e.g. "git version 2.24.1" or "git version 2.20.1 (Apple
+// Git-117)".
+func parseGitVersion(s string) (major, minor int, err error) {
+	fields := strings.Fields(s)
+	if len(fields) < 3 || fields[0] != "git" || fields[1] != "version" {
+		return 0, 0, errors.Errorf("unexpected git version output %q", s)
+	}
+	parts := strings.SplitN(fields[2], ".", 3)
+	if len(parts) < 2 {
+		return 0, 0, errors.Errorf("unexpected git version %q", fields[2])
+	}
+	if major, err = strconv.Atoi(parts[0]); err != nil {
+		return 0, 0, errors.Wrapf(err, "unexpected git version %q", fields[2])
+	}
+	if minor, err = strconv.Atoi(parts[1]); err != nil {
+		return 0, 0, errors.Wrapf(err, "unexpected git version %q", fields[2])
+	}
+	return major, minor, nil
+}
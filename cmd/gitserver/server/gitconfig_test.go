@@ -0,0 +1,247 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/sourcegraph/sourcegraph/internal/api"
+)
+
+func TestRemoteGitConfigArgs(t *testing.T) {
+	s := &Server{
+		GitMemoryConfig: GitMemoryConfig{
+			PackWindowMemory: "100m",
+			BigFileThreshold: "50m",
+		},
+		RepoOptions: map[api.RepoName]RepoOptions{
+			"github.com/foo/monorepo": {
+				Memory: GitMemoryConfig{
+					PackWindowMemory: "10m",
+					PackSizeLimit:    "1g",
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		name string
+		s    *Server
+		repo api.RepoName
+		want []string
+	}{
+		{
+			name: "unconfigured",
+			s:    &Server{},
+			repo: "github.com/foo/bar",
+			want: nil,
+		},
+		{
+			name: "global",
+			s:    s,
+			repo: "github.com/foo/bar",
+			want: []string{"-c", "pack.windowMemory=100m", "-c", "core.bigFileThreshold=50m"},
+		},
+		{
+			name: "hooks",
+			s:    &Server{GitHooksDir: "/etc/gitserver/hooks"},
+			repo: "github.com/foo/bar",
+			want: []string{"-c", "core.hooksPath=/etc/gitserver/hooks"},
+		},
+		{
+			name: "compression",
+			s: &Server{
+				GitCompression: "1",
+				RepoOptions: map[api.RepoName]RepoOptions{
+					"github.com/foo/monorepo": {Compression: "9"},
+				},
+			},
+			repo: "github.com/foo/bar",
+			want: []string{"-c", "core.compression=1"},
+		},
+		{
+			name: "compression override",
+			s: &Server{
+				GitCompression: "1",
+				RepoOptions: map[api.RepoName]RepoOptions{
+					"github.com/foo/monorepo": {Compression: "9"},
+				},
+			},
+			repo: "github.com/foo/monorepo",
+			want: []string{"-c", "core.compression=9"},
+		},
+		{
+			name: "user agent",
+			s: &Server{
+				GitUserAgent: "Sourcegraph",
+				GitUserAgentOverrides: map[string]string{
+					"https://gitlab.example.com": "Sourcegraph-GitLab",
+					"https://github.com":         "Sourcegraph-GitHub",
+				},
+			},
+			repo: "github.com/foo/bar",
+			want: []string{
+				"-c", "http.userAgent=Sourcegraph",
+				"-c", "http.https://github.com.userAgent=Sourcegraph-GitHub",
+				"-c", "http.https://gitlab.example.com.userAgent=Sourcegraph-GitLab",
+			},
+		},
+		{
+			name: "override",
+			s:    s,
+			repo: "github.com/Foo/Monorepo.git",
+			want: []string{"-c", "pack.windowMemory=10m", "-c", "pack.packSizeLimit=1g", "-c", "core.bigFileThreshold=50m"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.s.remoteGitConfigArgs(tt.repo)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("\ngot:  %q\nwant: %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFetchRefspecs(t *testing.T) {
+	s := &Server{
+		RepoOptions: map[api.RepoName]RepoOptions{
+			"github.com/foo/releases": {TagPattern: "v*"},
+		},
+	}
+
+	tests := []struct {
+		repo api.RepoName
+		want []string
+	}{
+		{
+			repo: "github.com/foo/bar",
+			want: []string{"+refs/heads/*:refs/heads/*", "+refs/tags/*:refs/tags/*", "+refs/pull/*:refs/pull/*"},
+		},
+		{
+			repo: "github.com/Foo/Releases",
+			want: []string{"+refs/heads/*:refs/heads/*", "+refs/tags/v*:refs/tags/v*", "+refs/pull/*:refs/pull/*"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.repo), func(t *testing.T) {
+			got := s.fetchRefspecs(tt.repo)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("\ngot:  %q\nwant: %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRepoOptions_Validate(t *testing.T) {
+	for _, p := range []string{"", "v*", "release-*", "v1.0.0", "releases/*"} {
+		if err := (RepoOptions{TagPattern: p}).Validate(); err != nil {
+			t.Errorf("unexpected error for tag pattern %q: %s", p, err)
+		}
+	}
+	for _, p := range []string{"v*.*", "v*:refs/heads/*", "v[0-9]*", "v?"} {
+		if err := (RepoOptions{TagPattern: p}).Validate(); err == nil {
+			t.Errorf("expected error for tag pattern %q", p)
+		}
+	}
+	for _, c := range []string{"", "-1", "0", "9"} {
+		if err := (RepoOptions{Compression: c}).Validate(); err != nil {
+			t.Errorf("unexpected error for compression %q: %s", c, err)
+		}
+	}
+	for _, c := range []string{"10", "-2", "best"} {
+		if err := (RepoOptions{Compression: c}).Validate(); err == nil {
+			t.Errorf("expected error for compression %q", c)
+		}
+	}
+	if err := (RepoOptions{MaxFetchSize: -1}).Validate(); err == nil {
+		t.Error("expected error for negative max fetch size")
+	}
+	if err := (RepoOptions{RemoteScheme: RemoteSchemeSSH}).Validate(); err != nil {
+		t.Errorf("unexpected error for remote scheme: %s", err)
+	}
+	if err := (RepoOptions{RemoteScheme: "ftp"}).Validate(); err == nil {
+		t.Error("expected error for remote scheme ftp")
+	}
+	if err := (RepoOptions{SparseCheckout: []string{"/docs/", "!*.png"}}).Validate(); err != nil {
+		t.Errorf("unexpected error for sparse checkout patterns: %s", err)
+	}
+	for _, p := range []string{"", " ", "/docs/\n/src/"} {
+		if err := (RepoOptions{SparseCheckout: []string{p}}).Validate(); err == nil {
+			t.Errorf("expected error for sparse checkout pattern %q", p)
+		}
+	}
+}
+
+func TestFetchArgs(t *testing.T) {
+	defer func(orig func() (int, int, error)) { gitVersion = orig }(gitVersion)
+
+	refspecs := []string{"+refs/heads/*:refs/heads/*"}
+	tests := []struct {
+		name    string
+		enabled bool
+		major   int
+		minor   int
+		want    []string
+	}{
+		{
+			name:  "disabled",
+			major: 2,
+			minor: 24,
+			want:  []string{"fetch", "--prune", "--progress", "https://example.com/foo", "+refs/heads/*:refs/heads/*"},
+		},
+		{
+			name:    "enabled",
+			enabled: true,
+			major:   2,
+			minor:   24,
+			want: []string{
+				"-c", "fetch.negotiationAlgorithm=skipping",
+				"fetch", "--prune", "--progress", "--negotiation-tip=refs/heads/*", "https://example.com/foo", "+refs/heads/*:refs/heads/*",
+			},
+		},
+		{
+			name:    "enabled but git too old",
+			enabled: true,
+			major:   2,
+			minor:   18,
+			want:    []string{"fetch", "--prune", "--progress", "https://example.com/foo", "+refs/heads/*:refs/heads/*"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gitVersion = func() (int, int, error) { return tt.major, tt.minor, nil }
+			s := &Server{FetchNegotiationSkipping: tt.enabled}
+			got := s.fetchArgs("github.com/foo/bar", "https://example.com/foo", refspecs)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("\ngot:  %q\nwant: %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseGitVersion(t *testing.T) {
+	tests := []struct {
+		s            string
+		major, minor int
+	}{
+		{"git version 2.24.1\n", 2, 24},
+		{"git version 2.20.1 (Apple Git-117)", 2, 20},
+		{"git version 2.24.1.windows.2", 2, 24},
+		{"git version 3.0", 3, 0},
+	}
+	for _, tt := range tests {
+		major, minor, err := parseGitVersion(tt.s)
+		if err != nil {
+			t.Errorf("parseGitVersion(%q): %s", tt.s, err)
+			continue
+		}
+		if major != tt.major || minor != tt.minor {
+			t.Errorf("parseGitVersion(%q) = %d.%d, want %d.%d", tt.s, major, minor, tt.major, tt.minor)
+		}
+	}
+	for _, s := range []string{"", "hub version 2.24.1", "git version two"} {
+		if _, _, err := parseGitVersion(s); err == nil {
+			t.Errorf("parseGitVersion(%q): expected error", s)
+		}
+	}
+}
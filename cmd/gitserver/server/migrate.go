@@ -0,0 +1,223 @@
+package server
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/sourcegraph/sourcegraph/internal/api"
+	"github.com/sourcegraph/sourcegraph/internal/gitserver/protocol"
+	log15 "gopkg.in/inconshreveable/log15.v2"
+)
+
+// previousDir returns the GIT_DIR of name in s.PreviousReposDir.
+func (s *Server) previousDir(name api.RepoName) GitDir {
+	path := string(protocol.NormalizeRepo(name))
+	return GitDir(filepath.Join(s.PreviousReposDir, filepath.FromSlash(path), ".git"))
+}
+
+// inPreviousReposDir reports whether name still has to be moved from
+// s.PreviousReposDir.
+func (s *Server) inPreviousReposDir(name api.RepoName) bool {
+	if s.PreviousReposDir == "" {
+		return false
+	}
+	_, err := os.Stat(s.previousDir(name).Path("HEAD"))
+	return err == nil
+}
+
+// MigrateRepos moves all repositories from s.PreviousReposDir to
+// s.ReposDir. It can run while serving requests: repositories which are
+// requested before they are moved are moved on demand instead of cloned. If
+// it is interrupted, running it again resumes the migration.
+func (s *Server) MigrateRepos(ctx context.Context) error {
+	if s.PreviousReposDir == "" {
+		return nil
+	}
+
+	var names []api.RepoName
+	err := s.walkGitDirs(ctx, s.PreviousReposDir, false, func(dir GitDir) error {
+		// Like inPreviousReposDir, only repositories with a HEAD are moved.
+		if _, err := os.Stat(dir.Path("HEAD")); err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(s.PreviousReposDir, filepath.Dir(string(dir)))
+		if err != nil {
+			return err
+		}
+		names = append(names, api.RepoName(filepath.ToSlash(rel)))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	log15.Info("migrating repositories", "from", s.PreviousReposDir, "to", s.ReposDir, "count", len(names))
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if _, err := s.migrateRepo(ctx, name); err != nil {
+			log15.Error("failed to migrate repository", "repo", name, "error", err)
+		}
+	}
+	log15.Info("migrated repositories", "from", s.PreviousReposDir, "to", s.ReposDir)
+	return nil
+}
+
+// migrateRepo moves name from s.PreviousReposDir to s.ReposDir under the
+// repository lock. It returns false if name is not in s.PreviousReposDir or
+// is locked by a clone or another migration.
+//
+// The GIT_DIR is renamed if both directories are on the same device.
+// Otherwise it is copied to a temporary directory, verified and then renamed
+// into place. The previous GIT_DIR is only removed once the new one is
+// complete, so an interrupted migration never loses a repository.
+func (s *Server) migrateRepo(ctx context.Context, name api.RepoName) (bool, error) {
+	if !s.inPreviousReposDir(name) {
+		return false, nil
+	}
+	src, dst := s.previousDir(name), s.dir(name)
+
+	lock, ok := s.locker.TryAcquire(dst, "migrating repository")
+	if !ok {
+		return false, nil
+	}
+	defer lock.Release()
+
+	if _, err := os.Stat(dst.Path("HEAD")); os.IsNotExist(err) {
+		if err := s.moveGitDir(src, dst); err != nil {
+			return false, err
+		}
+	} else {
+		// A previous migration was interrupted after dst was complete.
+		if err := os.RemoveAll(string(src)); err != nil {
+			return false, err
+		}
+	}
+
+	// The work tree is checked out again at the new location. Files of the
+	// previous work tree are left behind if it contains nested
+	// repositories which are not migrated yet.
+	if err := removeWorkTree(filepath.Dir(string(src))); err != nil {
+		log15.Warn("failed to remove previous work tree", "repo", name, "error", err)
+	}
+	_ = os.Remove(filepath.Dir(string(src)))
+	if err := s.updateWorkTree(ctx, name, dst); err != nil {
+		return true, errors.Wrap(err, "failed to check out work tree")
+	}
+
+	log15.Info("migrated repository", "repo", name)
+	return true, nil
+}
+
+// moveGitDir moves src to dst, copying it if they are on different devices.
+func (s *Server) moveGitDir(src, dst GitDir) error {
+	if err := os.RemoveAll(string(dst)); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(string(dst)), os.ModePerm); err != nil {
+		return err
+	}
+
+	err := renameAndSync(string(src), string(dst))
+	if le, ok := err.(*os.LinkError); !ok || le.Err != syscall.EXDEV {
+		return err
+	}
+
+	// The temporary directory is cleared on startup, so an interrupted copy
+	// starts over.
+	tmp, err := s.tempDirFor(dst, "migrate-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	tmpDir := filepath.Join(tmp, ".git")
+	if err := copyDir(string(src), tmpDir); err != nil {
+		return errors.Wrap(err, "failed to copy repository")
+	}
+	if err := verifyCopy(src, GitDir(tmpDir)); err != nil {
+		return err
+	}
+	if err := renameAndSync(tmpDir, string(dst)); err != nil {
+		return err
+	}
+	return os.RemoveAll(string(src))
+}
+
+// verifyCopy checks that the copy has the same size and refs as the
+// original repository.
+func verifyCopy(orig, copy GitDir) error {
+	origSize, err := dirSize(string(orig))
+	if err != nil {
+		return err
+	}
+	copySize, err := dirSize(string(copy))
+	if err != nil {
+		return err
+	}
+	if origSize != copySize {
+		return errors.Errorf("copied repository has size %d, want %d", copySize, origSize)
+	}
+
+	origRefs, err := repoRefs(context.Background(), orig)
+	if err != nil {
+		return err
+	}
+	copyRefs, err := repoRefs(context.Background(), copy)
+	if err != nil {
+		return errors.Wrap(err, "copied repository is invalid")
+	}
+	if !reflect.DeepEqual(origRefs, copyRefs) {
+		return errors.New("copied repository has different refs")
+	}
+	return nil
+}
+
+// copyDir recursively copies the directories and regular files of src to
+// dst, which must not exist.
+func copyDir(src, dst string) error {
+	return filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		switch {
+		case fi.IsDir():
+			return os.Mkdir(target, fi.Mode().Perm())
+		case fi.Mode().IsRegular():
+			return copyFile(path, target, fi.Mode().Perm())
+		default:
+			return errors.Errorf("unsupported file type %s", path)
+		}
+	})
+}
+
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
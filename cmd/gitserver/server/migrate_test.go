@@ -0,0 +1,209 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sourcegraph/sourcegraph/internal/api"
+	"github.com/sourcegraph/sourcegraph/internal/gitserver/protocol"
+	"github.com/sourcegraph/sourcegraph/internal/mutablelimiter"
+)
+
+func newMigrateTestServer(t *testing.T) (s *Server, remote string, cleanup func()) {
+	remote, cleanup1 := tmpDir(t)
+	runCmd(t, remote, "git", "init", ".")
+	runCmd(t, remote, "sh", "-c", "echo hello > hello.txt")
+	runCmd(t, remote, "git", "add", ".")
+	runCmd(t, remote, "git", "commit", "-m", "hello")
+
+	reposDir, cleanup2 := tmpDir(t)
+	prevReposDir, cleanup3 := tmpDir(t)
+	s = &Server{
+		ReposDir:         reposDir,
+		PreviousReposDir: prevReposDir,
+		ctx:              context.Background(),
+		locker:           &RepositoryLocker{},
+		cloneLimiter:     mutablelimiter.New(1),
+		cloneableLimiter: mutablelimiter.New(1),
+		repoUpdateLocks:  make(map[api.RepoName]*locks),
+		CloneWorkTree:    true,
+	}
+	return s, remote, func() {
+		cleanup3()
+		cleanup2()
+		cleanup1()
+	}
+}
+
+// cloneToPreviousReposDir clones remote like gitserver did before its
+// storage was relocated.
+func cloneToPreviousReposDir(t *testing.T, s *Server, repo api.RepoName, remote string) GitDir {
+	t.Helper()
+	src := s.previousDir(repo)
+	if err := os.MkdirAll(filepath.Dir(string(src)), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	runCmd(t, filepath.Dir(string(src)), "git", "clone", "--mirror", remote, ".git")
+	writeFile(t, filepath.Join(filepath.Dir(string(src)), "hello.txt"), []byte("hello\n"))
+	return src
+}
+
+func TestMigrateRepos(t *testing.T) {
+	s, remote, cleanup := newMigrateTestServer(t)
+	defer cleanup()
+	repo := api.RepoName("example.com/foo/bar")
+	src := cloneToPreviousReposDir(t, s, repo, remote)
+	want := runCmd(t, string(src), "git", "rev-parse", "HEAD")
+
+	// The repository is reported as cloned before it is moved.
+	body, err := json.Marshal(protocol.IsRepoClonedRequest{Repo: repo})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, httptest.NewRequest("POST", "/is-repo-cloned", bytes.NewReader(body)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d for a repository in the previous repos dir, want %d", rr.Code, http.StatusOK)
+	}
+
+	if err := s.MigrateRepos(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := s.dir(repo)
+	if got := runCmd(t, string(dst), "git", "rev-parse", "HEAD"); got != want {
+		t.Errorf("got HEAD %q after migrating, want %q", got, want)
+	}
+	if _, err := os.Stat(filepath.Dir(string(src))); !os.IsNotExist(err) {
+		t.Errorf("expected previous repository to be removed, got %v", err)
+	}
+	assertFiles(t, filepath.Dir(string(dst)), "hello.txt")
+	if s.inPreviousReposDir(repo) {
+		t.Error("expected repository to be migrated")
+	}
+}
+
+func TestMigrateRepos_skipsTempDirs(t *testing.T) {
+	s, remote, cleanup := newMigrateTestServer(t)
+	defer cleanup()
+	s.StorageCloneLimits = map[string]int{"ssd": 1}
+
+	// Clones in progress in the temporary directories of the previous repos
+	// dir and of its storage devices are not repositories.
+	for _, repo := range []api.RepoName{".tmp/clone", "ssd/.tmp/clone"} {
+		cloneToPreviousReposDir(t, s, repo, remote)
+	}
+	repo := api.RepoName("ssd/example.com/foo/bar")
+	cloneToPreviousReposDir(t, s, repo, remote)
+
+	if err := s.MigrateRepos(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if s.inPreviousReposDir(repo) {
+		t.Error("expected repository to be migrated")
+	}
+	for _, name := range []api.RepoName{".tmp/clone", "ssd/.tmp/clone"} {
+		if !s.inPreviousReposDir(name) {
+			t.Errorf("expected temporary directory %s not to be migrated", name)
+		}
+	}
+}
+
+func TestMigrateRepo_onDemand(t *testing.T) {
+	s, remote, cleanup := newMigrateTestServer(t)
+	defer cleanup()
+	repo := api.RepoName("example.com/foo/bar")
+	cloneToPreviousReposDir(t, s, repo, remote)
+
+	// Cloning a repository which is in the previous repos dir moves it
+	// instead, which also works without access to the remote.
+	if _, err := s.cloneRepo(context.Background(), repo, "", &cloneOptions{Block: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(s.dir(repo).Path("HEAD")); err != nil {
+		t.Fatalf("expected repository to be migrated: %v", err)
+	}
+	if s.inPreviousReposDir(repo) {
+		t.Error("expected repository to be removed from the previous repos dir")
+	}
+}
+
+func TestMigrateRepo_repoInfo(t *testing.T) {
+	s, remote, cleanup := newMigrateTestServer(t)
+	defer cleanup()
+	repo := api.RepoName("example.com/foo/bar")
+	cloneToPreviousReposDir(t, s, repo, remote)
+
+	// Repositories which are not migrated yet are reported as cloned.
+	info, err := s.repoInfo(context.Background(), repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Cloned || info.URL != remote || info.LastFetched == nil {
+		t.Errorf("got cloned=%v, url=%q, lastFetched=%v for an unmigrated repository, want cloned from %q", info.Cloned, info.URL, info.LastFetched, remote)
+	}
+}
+
+func TestMigrateRepo_resume(t *testing.T) {
+	s, remote, cleanup := newMigrateTestServer(t)
+	defer cleanup()
+	repo := api.RepoName("example.com/foo/bar")
+	src := cloneToPreviousReposDir(t, s, repo, remote)
+	want := runCmd(t, string(src), "git", "rev-parse", "HEAD")
+
+	// Simulate a migration which was interrupted after copying the
+	// repository, but before removing the previous one.
+	dst := s.dir(repo)
+	if err := os.MkdirAll(filepath.Dir(string(dst)), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := copyDir(string(src), string(dst)); err != nil {
+		t.Fatal(err)
+	}
+
+	if migrated, err := s.migrateRepo(context.Background(), repo); err != nil || !migrated {
+		t.Fatalf("got migrated=%v, err=%v", migrated, err)
+	}
+	if got := runCmd(t, string(dst), "git", "rev-parse", "HEAD"); got != want {
+		t.Errorf("got HEAD %q after resuming, want %q", got, want)
+	}
+	if _, err := os.Stat(string(src)); !os.IsNotExist(err) {
+		t.Errorf("expected previous repository to be removed, got %v", err)
+	}
+
+	// Migrating again is a no-op.
+	if migrated, err := s.migrateRepo(context.Background(), repo); err != nil || migrated {
+		t.Fatalf("got migrated=%v, err=%v for a migrated repository", migrated, err)
+	}
+}
+
+func TestCopyDir_verifyCopy(t *testing.T) {
+	s, remote, cleanup := newMigrateTestServer(t)
+	defer cleanup()
+	src := cloneToPreviousReposDir(t, s, "example.com/foo/bar", remote)
+
+	// This is the path taken when migrating across devices.
+	tmp, err := s.tempDir("migrate-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := GitDir(filepath.Join(tmp, ".git"))
+	if err := copyDir(string(src), string(dst)); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyCopy(src, dst); err != nil {
+		t.Fatalf("unexpected error verifying copy: %v", err)
+	}
+
+	// A copy with different refs is rejected.
+	runCmd(t, string(dst), "git", "update-ref", "refs/heads/other", "HEAD")
+	if err := verifyCopy(src, dst); err == nil {
+		t.Error("expected error verifying a copy with different refs")
+	}
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"context"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/sourcegraph/sourcegraph/internal/api"
+	log15 "gopkg.in/inconshreveable/log15.v2"
+)
+
+// postFetchCommandTimeout bounds how long a PostFetchCommand may run, since
+// it runs while the repository update lock is held.
+const postFetchCommandTimeout = time.Minute
+
+// postFetchCommandPath is the PATH of PostFetchCommand, so it doesn't depend
+// on the environment of gitserver.
+const postFetchCommandPath = "/usr/local/bin:/usr/bin:/bin"
+
+// runPostFetchCommand runs s.PostFetchCommand, if set, after a successful
+// fetch of repo into dir. Failures are logged, but don't fail the fetch.
+//
+// 🚨 SECURITY: The command must never see the remote URL, which can contain
+// credentials, nor the environment of gitserver. It only gets a fixed PATH
+// and the repository via SRC_REPO_NAME and SRC_REPO_DIR.
+func (s *Server) runPostFetchCommand(ctx context.Context, repo api.RepoName, dir GitDir) {
+	if s.PostFetchCommand == "" {
+		return
+	}
+	path, err := filepath.Abs(string(dir))
+	if err != nil {
+		log15.Error("failed to run post-fetch command", "repo", repo, "error", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, postFetchCommandTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, s.PostFetchCommand)
+	cmd.Dir = path
+	cmd.Env = []string{
+		"PATH=" + postFetchCommandPath,
+		"SRC_REPO_NAME=" + string(repo),
+		"SRC_REPO_DIR=" + path,
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		log15.Error("post-fetch command failed", "repo", repo, "command", s.PostFetchCommand, "error", err, "output", string(out))
+	}
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sourcegraph/sourcegraph/internal/api"
+	"github.com/sourcegraph/sourcegraph/internal/mutablelimiter"
+)
+
+func TestServer_runPostFetchCommand(t *testing.T) {
+	remote, cleanup1 := tmpDir(t)
+	defer cleanup1()
+	reposDir, cleanup2 := tmpDir(t)
+	defer cleanup2()
+	scriptDir, cleanup3 := tmpDir(t)
+	defer cleanup3()
+
+	runCmd(t, remote, "git", "init", ".")
+	runCmd(t, remote, "git", "commit", "--allow-empty", "-m", "initial")
+
+	out := filepath.Join(scriptDir, "env.txt")
+	script := filepath.Join(scriptDir, "post-fetch")
+	writeFile(t, script, []byte("#!/bin/sh\nenv > "+out+"\n"))
+	if err := os.Chmod(script, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// The command must not see the environment of gitserver.
+	os.Setenv("POST_FETCH_TEST_SECRET", "hunter2")
+	defer os.Unsetenv("POST_FETCH_TEST_SECRET")
+
+	s := &Server{
+		ReposDir:         reposDir,
+		ctx:              context.Background(),
+		locker:           &RepositoryLocker{},
+		cloneLimiter:     mutablelimiter.New(1),
+		cloneableLimiter: mutablelimiter.New(1),
+		repoUpdateLocks:  make(map[api.RepoName]*locks),
+		PostFetchCommand: script,
+	}
+	repo := api.RepoName("example.com/foo/bar")
+	if _, err := s.cloneRepo(context.Background(), repo, remote, &cloneOptions{Block: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.doRepoUpdate(context.Background(), repo, remote); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatalf("post-fetch command did not run: %v", err)
+	}
+	env := string(b)
+	for _, want := range []string{
+		"PATH=" + postFetchCommandPath + "\n",
+		"SRC_REPO_NAME=" + string(repo) + "\n",
+		"SRC_REPO_DIR=" + string(s.dir(repo)) + "\n",
+	} {
+		if !strings.Contains(env, want) {
+			t.Errorf("got environment %q, want it to contain %q", env, want)
+		}
+	}
+	if strings.Contains(env, "hunter2") || strings.Contains(env, remote) {
+		t.Errorf("got environment %q, want it to contain neither the environment of gitserver nor the remote", env)
+	}
+
+	// A failed fetch doesn't run the command.
+	if err := os.Remove(out); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(remote); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.doRepoUpdate(context.Background(), repo, remote); err == nil {
+		t.Fatal("expected fetch from a missing remote to fail")
+	}
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Errorf("post-fetch command ran after a failed fetch: %v", err)
+	}
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/sourcegraph/sourcegraph/internal/api"
+)
+
+// FetchValidator validates the objects and refs fetched into a quarantine
+// repository before they are promoted into the live repository. Returning an
+// error discards the fetch, leaving the live repository unchanged.
+type FetchValidator func(ctx context.Context, quarantine GitDir) error
+
+// FsckFetchValidator checks the connectivity of all objects reachable from
+// the quarantined refs. Since it walks the whole history it can be slow for
+// large repositories.
+func FsckFetchValidator(ctx context.Context, quarantine GitDir) error {
+	cmd := exec.CommandContext(ctx, "git", "fsck", "--connectivity-only", "--no-dangling", "--no-progress")
+	cmd.Dir = string(quarantine)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "git fsck failed: %s", bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// fetchQuarantined fetches refspecs from url into a quarantine repository,
+// runs s.FetchValidators against it and only then promotes the fetched
+// objects and refs into dir.
+//
+// The quarantine repository borrows the objects of dir via alternates and
+// starts out with a copy of its refs, so the fetch from url only transfers
+// new objects. Promotion is a local fetch from the quarantine repository.
+func (s *Server) fetchQuarantined(ctx context.Context, repo api.RepoName, dir GitDir, url string, refspecs []string, progress io.Writer) ([]byte, error) {
+	// Create the quarantine on the storage device of dir, which receives
+	// its objects.
+	tmp, err := s.tempDirFor(dir, "quarantine-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+	quarantine := GitDir(filepath.Join(tmp, ".git"))
+
+	if err := initQuarantine(ctx, dir, quarantine); err != nil {
+		return nil, errors.Wrap(err, "failed to create quarantine repository")
+	}
+
+	cmd := exec.CommandContext(ctx, "git", s.fetchArgs(repo, url, refspecs)...)
+	cmd.Dir = string(quarantine)
+	output, err := s.runWithRemoteOpts(ctx, cmd, progress)
+	if err != nil {
+		return output, err
+	}
+
+	// The quarantine repository borrows existing objects, so its objects
+	// are the ones added by the fetch.
+	if limit := s.maxFetchSize(repo); limit > 0 {
+		size, err := dirSize(quarantine.Path("objects"))
+		if err != nil {
+			return output, err
+		}
+		if size > limit {
+			return output, errors.Errorf("fetch of %d bytes exceeds the limit of %d bytes", size, limit)
+		}
+	}
+
+	for _, validate := range s.FetchValidators {
+		if err := validate(ctx, quarantine); err != nil {
+			return output, errors.Wrap(err, "fetched objects failed validation")
+		}
+	}
+
+	args := append([]string{"fetch", "--prune", string(quarantine)}, refspecs...)
+	cmd = exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = string(dir)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return append(output, out...), errors.Wrap(err, "failed to promote quarantined objects")
+	}
+	return output, nil
+}
+
+// maxFetchSize returns the maximum number of bytes a fetch may add to repo,
+// or zero if it is unlimited.
+func (s *Server) maxFetchSize(repo api.RepoName) int64 {
+	if n := s.repoOptions(repo).MaxFetchSize; n != 0 {
+		return n
+	}
+	return s.MaxFetchSize
+}
+
+// initQuarantine creates a bare repository at quarantine which shares the
+// objects and has the same refs as dir.
+func initQuarantine(ctx context.Context, dir, quarantine GitDir) error {
+	cmd := exec.CommandContext(ctx, "git", "init", "--bare", string(quarantine))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "git init failed: %s", bytes.TrimSpace(out))
+	}
+
+	objects, err := filepath.Abs(dir.Path("objects"))
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(quarantine.Path("objects", "info", "alternates"), []byte(objects+"\n"), 0600); err != nil {
+		return err
+	}
+
+	cmd = exec.CommandContext(ctx, "git", "for-each-ref", "--format=create %(refname) %(objectname)")
+	cmd.Dir = string(dir)
+	refs, err := cmd.Output()
+	if err != nil {
+		return wrapCmdError(cmd, err)
+	}
+	cmd = exec.CommandContext(ctx, "git", "update-ref", "--stdin")
+	cmd.Dir = string(quarantine)
+	cmd.Stdin = bytes.NewReader(refs)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "git update-ref failed: %s", bytes.TrimSpace(out))
+	}
+	return nil
+}
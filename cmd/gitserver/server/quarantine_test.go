@@ -0,0 +1,133 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/sourcegraph/sourcegraph/internal/api"
+	"github.com/sourcegraph/sourcegraph/internal/mutablelimiter"
+)
+
+func TestDoRepoUpdate_quarantine(t *testing.T) {
+	remote, cleanup1 := tmpDir(t)
+	defer cleanup1()
+	reposDir, cleanup2 := tmpDir(t)
+	defer cleanup2()
+
+	runCmd(t, remote, "git", "init", ".")
+	runCmd(t, remote, "sh", "-c", "echo hello world > hello.txt")
+	runCmd(t, remote, "git", "add", "hello.txt")
+	runCmd(t, remote, "git", "commit", "-m", "hello")
+
+	var rejectErr error
+	s := &Server{
+		ReposDir:         reposDir,
+		ctx:              context.Background(),
+		locker:           &RepositoryLocker{},
+		cloneLimiter:     mutablelimiter.New(1),
+		cloneableLimiter: mutablelimiter.New(1),
+		repoUpdateLocks:  make(map[api.RepoName]*locks),
+		FetchValidators: []FetchValidator{
+			FsckFetchValidator,
+			func(ctx context.Context, quarantine GitDir) error { return rejectErr },
+		},
+	}
+	repo := api.RepoName("example.com/foo/bar")
+	if _, err := s.cloneRepo(context.Background(), repo, remote, &cloneOptions{Block: true}); err != nil {
+		t.Fatal(err)
+	}
+	dir := string(s.dir(repo))
+	before := runCmd(t, dir, "git", "rev-parse", "refs/heads/master")
+
+	runCmd(t, remote, "sh", "-c", "echo bye > bye.txt")
+	runCmd(t, remote, "git", "add", "bye.txt")
+	runCmd(t, remote, "git", "commit", "-m", "bye")
+	runCmd(t, remote, "git", "branch", "other")
+	after := runCmd(t, remote, "git", "rev-parse", "HEAD")
+
+	rejectErr = errors.New("rejected")
+	err := s.doRepoUpdate(context.Background(), repo, remote)
+	if err == nil || !strings.Contains(err.Error(), "rejected") {
+		t.Fatalf("expected rejected fetch, got %v", err)
+	}
+	if got := runCmd(t, dir, "git", "rev-parse", "refs/heads/master"); got != before {
+		t.Errorf("rejected fetch updated master from %s to %s", before, got)
+	}
+	if runCmd(t, dir, "git", "for-each-ref", "refs/heads/other") != "" {
+		t.Error("rejected fetch created branch other")
+	}
+	cmd := exec.Command("git", "cat-file", "-e", strings.TrimSpace(after))
+	cmd.Dir = dir
+	if cmd.Run() == nil {
+		t.Error("rejected fetch left the fetched commit in the repository")
+	}
+
+	rejectErr = nil
+	if err := s.doRepoUpdate(context.Background(), repo, remote); err != nil {
+		t.Fatal(err)
+	}
+	if got := runCmd(t, dir, "git", "rev-parse", "refs/heads/master"); got != after {
+		t.Errorf("got master %s after validated fetch, want %s", got, after)
+	}
+	if got := runCmd(t, dir, "git", "rev-parse", "refs/heads/other"); got != after {
+		t.Errorf("got other %s after validated fetch, want %s", got, after)
+	}
+}
+
+func TestDoRepoUpdate_maxFetchSize(t *testing.T) {
+	remote, cleanup1 := tmpDir(t)
+	defer cleanup1()
+	reposDir, cleanup2 := tmpDir(t)
+	defer cleanup2()
+
+	runCmd(t, remote, "git", "init", ".")
+	runCmd(t, remote, "git", "commit", "--allow-empty", "-m", "initial")
+
+	repo := api.RepoName("example.com/foo/bar")
+	s := &Server{
+		ReposDir:         reposDir,
+		ctx:              context.Background(),
+		locker:           &RepositoryLocker{},
+		cloneLimiter:     mutablelimiter.New(1),
+		cloneableLimiter: mutablelimiter.New(1),
+		repoUpdateLocks:  make(map[api.RepoName]*locks),
+		MaxFetchSize:     1 << 30,
+		RepoOptions:      map[api.RepoName]RepoOptions{repo: {MaxFetchSize: 16 << 10}},
+	}
+	if _, err := s.cloneRepo(context.Background(), repo, remote, &cloneOptions{Block: true}); err != nil {
+		t.Fatal(err)
+	}
+	dir := string(s.dir(repo))
+	before := runCmd(t, dir, "git", "rev-parse", "refs/heads/master")
+
+	// Random data doesn't compress, so the fetch adds more than the limit.
+	runCmd(t, remote, "sh", "-c", "head -c 65536 /dev/urandom > big.bin")
+	runCmd(t, remote, "git", "add", "big.bin")
+	runCmd(t, remote, "git", "commit", "-m", "big")
+	after := runCmd(t, remote, "git", "rev-parse", "HEAD")
+
+	err := s.doRepoUpdate(context.Background(), repo, remote)
+	if err == nil || !strings.Contains(err.Error(), "exceeds the limit") {
+		t.Fatalf("expected fetch exceeding the limit to be rejected, got %v", err)
+	}
+	if got := runCmd(t, dir, "git", "rev-parse", "refs/heads/master"); got != before {
+		t.Errorf("rejected fetch updated master from %s to %s", before, got)
+	}
+	cmd := exec.Command("git", "cat-file", "-e", strings.TrimSpace(after))
+	cmd.Dir = dir
+	if cmd.Run() == nil {
+		t.Error("rejected fetch left the fetched commit in the repository")
+	}
+
+	// Without the override the limit of the server applies.
+	s.RepoOptions = nil
+	if err := s.doRepoUpdate(context.Background(), repo, remote); err != nil {
+		t.Fatal(err)
+	}
+	if got := runCmd(t, dir, "git", "rev-parse", "refs/heads/master"); got != after {
+		t.Errorf("got master %s after fetch within the limit, want %s", got, after)
+	}
+}
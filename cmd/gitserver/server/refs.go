@@ -0,0 +1,147 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sourcegraph/sourcegraph/internal/gitserver/protocol"
+	log15 "gopkg.in/inconshreveable/log15.v2"
+)
+
+// Types of a gitRef.
+const (
+	refTypeBranch = "branch"
+	refTypeTag    = "tag"
+	refTypeOther  = "other"
+)
+
+// gitRef is a ref of a repository.
+type gitRef struct {
+	Name string // full name, e.g. refs/heads/master
+	OID  string // object the ref points to. For annotated tags this is the tag object.
+	Type string // refTypeBranch, refTypeTag or refTypeOther
+}
+
+// repoRefs returns all refs of the repository at dir, sorted by name.
+func repoRefs(ctx context.Context, dir GitDir) ([]gitRef, error) {
+	cmd := exec.CommandContext(ctx, "git", "for-each-ref", "--format=%(objectname) %(refname)")
+	cmd.Dir = string(dir)
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, wrapCmdError(cmd, err)
+	}
+
+	var refs []gitRef
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), " ", 2)
+		if len(fields) != 2 {
+			return nil, errors.Errorf("unexpected git for-each-ref output line %q", scanner.Text())
+		}
+		ref := gitRef{Name: fields[1], OID: fields[0], Type: refTypeOther}
+		switch {
+		case strings.HasPrefix(ref.Name, "refs/heads/"):
+			ref.Type = refTypeBranch
+		case strings.HasPrefix(ref.Name, "refs/tags/"):
+			ref.Type = refTypeTag
+		}
+		refs = append(refs, ref)
+	}
+	return refs, scanner.Err()
+}
+
+// danglingRefs returns the refs of dir which point at objects missing from
+// the repository.
+func danglingRefs(ctx context.Context, dir GitDir) ([]protocol.DanglingRef, error) {
+	refs, err := repoRefs(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(refs) == 0 {
+		return nil, nil
+	}
+
+	var in bytes.Buffer
+	for _, ref := range refs {
+		in.WriteString(ref.OID)
+		in.WriteByte('\n')
+	}
+	cmd := exec.CommandContext(ctx, "git", "cat-file", "--batch-check")
+	cmd.Dir = string(dir)
+	cmd.Stdin = &in
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, wrapCmdError(cmd, err)
+	}
+
+	// git cat-file prints one line per input line, in order. Missing objects
+	// are printed as "<oid> missing".
+	lines := strings.Split(strings.TrimSuffix(string(out), "\n"), "\n")
+	if len(lines) != len(refs) {
+		return nil, errors.Errorf("git cat-file returned %d lines for %d refs", len(lines), len(refs))
+	}
+	var dangling []protocol.DanglingRef
+	for i, line := range lines {
+		if strings.HasSuffix(line, " missing") {
+			dangling = append(dangling, protocol.DanglingRef{Name: refs[i].Name, OID: refs[i].OID})
+		}
+	}
+	return dangling, nil
+}
+
+// deleteDanglingRefs deletes refs from dir in a single transaction. A ref is
+// only deleted if it still points at the missing object, so refs updated by a
+// concurrent fetch are left alone and fail the transaction.
+func deleteDanglingRefs(ctx context.Context, dir GitDir, refs []protocol.DanglingRef) error {
+	var in bytes.Buffer
+	for _, ref := range refs {
+		fmt.Fprintf(&in, "delete %s %s\n", ref.Name, ref.OID)
+	}
+	cmd := exec.CommandContext(ctx, "git", "update-ref", "--stdin")
+	cmd.Dir = string(dir)
+	cmd.Stdin = &in
+	if _, err := cmd.Output(); err != nil {
+		return wrapCmdError(cmd, err)
+	}
+	return nil
+}
+
+func (s *Server) handleRepoRefsCheck(w http.ResponseWriter, r *http.Request) {
+	var req protocol.RepoRefsCheckRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dir := s.dir(req.Repo)
+	if !repoCloned(dir) {
+		http.Error(w, "repository not cloned", http.StatusNotFound)
+		return
+	}
+
+	dangling, err := danglingRefs(r.Context(), dir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp := protocol.RepoRefsCheckResponse{DanglingRefs: dangling}
+	if req.Repair && len(dangling) > 0 {
+		if err := deleteDanglingRefs(r.Context(), dir, dangling); err != nil {
+			log15.Error("failed to delete dangling refs", "repo", req.Repo, "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log15.Info("deleted dangling refs", "repo", req.Repo, "refs", len(dangling))
+		resp.Repaired = true
+	}
+
+	if err := json.NewEncoder(w).Encode(&resp); err != nil {
+		log15.Error("failed to encode response", "error", err)
+	}
+}
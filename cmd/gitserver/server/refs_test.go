@@ -0,0 +1,127 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sourcegraph/sourcegraph/internal/api"
+	"github.com/sourcegraph/sourcegraph/internal/gitserver/protocol"
+)
+
+func TestRepoRefs(t *testing.T) {
+	dir, cleanup := tmpDir(t)
+	defer cleanup()
+
+	runCmd(t, dir, "git", "init", ".")
+	runCmd(t, dir, "git", "commit", "--allow-empty", "-m", "first")
+	first := strings.TrimSpace(runCmd(t, dir, "git", "rev-parse", "HEAD"))
+	runCmd(t, dir, "git", "tag", "v1")
+	runCmd(t, dir, "git", "tag", "-a", "-m", "annotated", "v2")
+	tagObject := strings.TrimSpace(runCmd(t, dir, "git", "rev-parse", "refs/tags/v2"))
+	runCmd(t, dir, "git", "checkout", "-b", "feature")
+	runCmd(t, dir, "git", "commit", "--allow-empty", "-m", "second")
+	second := strings.TrimSpace(runCmd(t, dir, "git", "rev-parse", "HEAD"))
+	runCmd(t, dir, "git", "update-ref", "refs/pull/1/head", second)
+	runCmd(t, dir, "git", "branch", "-f", "master", first)
+
+	want := []gitRef{
+		{Name: "refs/heads/feature", OID: second, Type: refTypeBranch},
+		{Name: "refs/heads/master", OID: first, Type: refTypeBranch},
+		{Name: "refs/pull/1/head", OID: second, Type: refTypeOther},
+		{Name: "refs/tags/v1", OID: first, Type: refTypeTag},
+		{Name: "refs/tags/v2", OID: tagObject, Type: refTypeTag},
+	}
+
+	// Both the work tree and the GIT_DIR work.
+	for _, d := range []string{dir, dir + "/.git"} {
+		got, err := repoRefs(context.Background(), GitDir(d))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("repoRefs(%s):\ngot:  %+v\nwant: %+v", d, got, want)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := repoRefs(ctx, GitDir(dir)); err == nil {
+		t.Error("expected error for cancelled context")
+	}
+}
+
+func TestServer_handleRepoRefsCheck(t *testing.T) {
+	reposDir, cleanup := tmpDir(t)
+	defer cleanup()
+	s := &Server{ReposDir: reposDir}
+	h := s.Handler()
+
+	origRepoCloned := repoCloned
+	repoCloned = func(dir GitDir) bool { return true }
+	defer func() { repoCloned = origRepoCloned }()
+
+	repo := api.RepoName("example.com/foo/bar")
+	dir := string(s.dir(repo))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	runCmd(t, dir, "git", "init", "--bare", ".")
+	work, cleanup2 := tmpDir(t)
+	defer cleanup2()
+	runCmd(t, work, "git", "init", ".")
+	runCmd(t, work, "git", "commit", "--allow-empty", "-m", "first")
+	runCmd(t, work, "git", "push", dir, "HEAD:refs/heads/master")
+
+	// Simulate an interrupted fetch which updated a ref without receiving
+	// its object.
+	missing := "1111111111111111111111111111111111111111"
+	writeFile(t, filepath.Join(dir, "refs", "heads", "broken"), []byte(missing+"\n"))
+
+	check := func(repair bool) protocol.RepoRefsCheckResponse {
+		t.Helper()
+		body, err := json.Marshal(protocol.RepoRefsCheckRequest{Repo: repo, Repair: repair})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest("POST", "/repo-refs-check", bytes.NewReader(body)))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("got status %d: %s", rr.Code, rr.Body.String())
+		}
+		var resp protocol.RepoRefsCheckResponse
+		if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	want := protocol.RepoRefsCheckResponse{
+		DanglingRefs: []protocol.DanglingRef{{Name: "refs/heads/broken", OID: missing}},
+	}
+	if got := check(false); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	// Only checking must not modify the repository.
+	if got := check(false); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v after check, want %+v", got, want)
+	}
+
+	want.Repaired = true
+	if got := check(true); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if got := check(false); len(got.DanglingRefs) != 0 || got.Repaired {
+		t.Errorf("got %+v after repair, want no dangling refs", got)
+	}
+	if refs := runCmd(t, dir, "git", "for-each-ref", "--format=%(refname)"); refs != "refs/heads/master\n" {
+		t.Errorf("got refs %q after repair, want only master", refs)
+	}
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sourcegraph/sourcegraph/internal/api"
+	log15 "gopkg.in/inconshreveable/log15.v2"
+)
+
+// Values of RepoOptions.RemoteScheme.
+const (
+	RemoteSchemeSSH   = "ssh"
+	RemoteSchemeHTTPS = "https"
+)
+
+// remoteURL returns the URL git should clone or fetch repo from. It is url
+// rewritten according to RepoOptions.RemoteScheme, so the canonical URL of a
+// repository does not need to change to switch between SSH and HTTPS.
+func (s *Server) remoteURL(repo api.RepoName, url string) string {
+	scheme := s.repoOptions(repo).RemoteScheme
+	if scheme == "" {
+		return url
+	}
+	rewritten, err := rewriteRemoteScheme(url, scheme)
+	if err != nil {
+		// 🚨 SECURITY: The URL may contain a sensitive token.
+		log15.Warn("Unable to rewrite remote URL, using it unchanged.", "repo", repo, "scheme", scheme, "error", newURLRedactor(url).redact(err.Error()))
+		return url
+	}
+	return rewritten
+}
+
+// rewriteRemoteScheme rewrites rawurl, either an URL or an scp-like SSH
+// address such as git@github.com:foo/bar.git, to use scheme. It is returned
+// unchanged if it already uses scheme.
+//
+// 🚨 SECURITY: Credentials are only kept when rewriting to HTTPS. Over SSH
+// git authenticates with the SSH key of the host instead, so a token in
+// rawurl must not end up as the SSH user name.
+func rewriteRemoteScheme(rawurl, scheme string) (string, error) {
+	user, host, path, isSSH, err := splitRemoteURL(rawurl)
+	if err != nil {
+		return "", err
+	}
+
+	switch scheme {
+	case RemoteSchemeSSH:
+		if isSSH {
+			return rawurl, nil
+		}
+		return "git@" + host + ":" + path, nil
+
+	case RemoteSchemeHTTPS:
+		if strings.HasPrefix(rawurl, "https://") {
+			return rawurl, nil
+		}
+		u := &url.URL{Scheme: "https", Host: host, Path: "/" + path}
+		if !isSSH {
+			u.User = user
+		}
+		return u.String(), nil
+
+	default:
+		return "", errors.Errorf("unsupported remote scheme %q", scheme)
+	}
+}
+
+// splitRemoteURL splits rawurl into its user, host without port and path
+// without the leading slash. isSSH reports whether rawurl uses SSH.
+func splitRemoteURL(rawurl string) (user *url.Userinfo, host, path string, isSSH bool, err error) {
+	if !strings.Contains(rawurl, "://") {
+		// scp-like syntax: [user@]host:path
+		i := strings.Index(rawurl, ":")
+		if i < 0 || strings.Contains(rawurl[:i], "/") {
+			return nil, "", "", false, errors.Errorf("unsupported remote URL %q", rawurl)
+		}
+		host = rawurl[:i]
+		if j := strings.LastIndex(host, "@"); j >= 0 {
+			user, host = url.User(host[:j]), host[j+1:]
+		}
+		return user, host, strings.TrimPrefix(rawurl[i+1:], "/"), true, nil
+	}
+
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, "", "", false, err
+	}
+	switch u.Scheme {
+	case "ssh", "git+ssh":
+		isSSH = true
+	case "http", "https":
+	default:
+		return nil, "", "", false, errors.Errorf("unsupported remote URL scheme %q", u.Scheme)
+	}
+	return u.User, u.Hostname(), strings.TrimPrefix(u.Path, "/"), isSSH, nil
+}
+
+// withoutCredentials returns rawurl with the password and, unless it uses
+// SSH, the user removed. scp-like SSH addresses are returned unchanged,
+// since they don't contain secrets.
+func withoutCredentials(rawurl string) string {
+	if !strings.Contains(rawurl, "://") {
+		return rawurl
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return newURLRedactor(rawurl).redact(rawurl)
+	}
+	switch {
+	case u.User == nil:
+	case u.Scheme == "ssh" || u.Scheme == "git+ssh":
+		u.User = url.User(u.User.Username())
+	default:
+		u.User = nil
+	}
+	return u.String()
+}
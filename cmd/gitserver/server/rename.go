@@ -0,0 +1,112 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/sourcegraph/sourcegraph/internal/api"
+	"github.com/sourcegraph/sourcegraph/internal/gitserver/protocol"
+	log15 "gopkg.in/inconshreveable/log15.v2"
+)
+
+var (
+	errRenameNotCloned = errors.New("repository not cloned")
+	errRenameExists    = errors.New("a repository with the new name already exists")
+	errRenameBusy      = errors.New("repository is being cloned or updated")
+)
+
+// handleRepoRename moves a repository to a new name, e.g. after it was
+// renamed on the code host, so it doesn't have to be cloned again.
+func (s *Server) handleRepoRename(w http.ResponseWriter, r *http.Request) {
+	var req protocol.RepoRenameRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err := s.renameRepo(r.Context(), req.Repo, req.NewName)
+	switch errors.Cause(err) {
+	case nil:
+		log15.Info("renamed repository", "repo", req.Repo, "newName", req.NewName)
+	case errRenameNotCloned:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errRenameExists, errRenameBusy:
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		log15.Error("failed to rename repository", "repo", req.Repo, "newName", req.NewName, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// renameRepo moves the GIT_DIR of repo to newName. Its objects and state,
+// e.g. when it was last fetched, are kept.
+func (s *Server) renameRepo(ctx context.Context, repo, newName api.RepoName) error {
+	repo, newName = protocol.NormalizeRepo(repo), protocol.NormalizeRepo(newName)
+	if repo == newName {
+		return nil
+	}
+	src, dst := s.dir(repo), s.dir(newName)
+
+	// Lock both names, so neither is cloned or renamed concurrently.
+	srcLock, ok := s.locker.TryAcquire(src, "renaming repository")
+	if !ok {
+		return errRenameBusy
+	}
+	defer srcLock.Release()
+	dstLock, ok := s.locker.TryAcquire(dst, "renaming repository")
+	if !ok {
+		return errRenameBusy
+	}
+	defer dstLock.Release()
+	unlock, ok := s.lockRepoUpdates(repo)
+	if !ok {
+		return errRenameBusy
+	}
+	defer unlock()
+
+	if !repoCloned(src) {
+		return errRenameNotCloned
+	}
+	if repoCloned(dst) {
+		return errRenameExists
+	}
+
+	// Remove the remains of a failed clone of newName.
+	if err := os.RemoveAll(string(dst)); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(string(dst)), os.ModePerm); err != nil {
+		return err
+	}
+	if err := renameAndSync(string(src), string(dst)); err != nil {
+		return err
+	}
+
+	// Updates of repo which are waiting for the lock find it gone.
+	s.repoUpdateLocksMu.Lock()
+	delete(s.repoUpdateLocks, repo)
+	s.repoUpdateLocksMu.Unlock()
+	lastCheckMutex.Lock()
+	if t, ok := lastCheckAt[repo]; ok {
+		lastCheckAt[newName] = t
+		delete(lastCheckAt, repo)
+	}
+	lastCheckMutex.Unlock()
+
+	// Everything after this point is just cleanup of the previous location
+	// and checking out the work tree at the new one.
+	if workTree, ok := s.workTree(src); ok {
+		if err := removeWorkTree(workTree); err != nil {
+			log15.Warn("failed to remove work tree", "dir", workTree, "error", err)
+		}
+	}
+	s.removeEmptyParents(string(src))
+	if err := s.updateWorkTree(ctx, newName, dst); err != nil {
+		log15.Warn("failed to check out work tree", "repo", newName, "error", err)
+	}
+	return nil
+}
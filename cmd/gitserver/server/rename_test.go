@@ -0,0 +1,98 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sourcegraph/sourcegraph/internal/api"
+	"github.com/sourcegraph/sourcegraph/internal/gitserver/protocol"
+	"github.com/sourcegraph/sourcegraph/internal/mutablelimiter"
+)
+
+func TestServer_handleRepoRename(t *testing.T) {
+	remote, cleanup1 := tmpDir(t)
+	defer cleanup1()
+	runCmd(t, remote, "git", "init", ".")
+	runCmd(t, remote, "sh", "-c", "echo hello > hello.txt")
+	runCmd(t, remote, "git", "add", ".")
+	runCmd(t, remote, "git", "commit", "-m", "hello")
+
+	reposDir, cleanup2 := tmpDir(t)
+	defer cleanup2()
+	s := &Server{
+		ReposDir:         reposDir,
+		ctx:              context.Background(),
+		locker:           &RepositoryLocker{},
+		cloneLimiter:     mutablelimiter.New(1),
+		cloneableLimiter: mutablelimiter.New(1),
+		repoUpdateLocks:  make(map[api.RepoName]*locks),
+		CloneWorkTree:    true,
+	}
+	h := s.Handler()
+
+	repo, newName := api.RepoName("github.com/foo/bar"), api.RepoName("github.com/foo/baz")
+	if _, err := s.cloneRepo(context.Background(), repo, remote, &cloneOptions{Block: true}); err != nil {
+		t.Fatal(err)
+	}
+	src, dst := s.dir(repo), s.dir(newName)
+	want := runCmd(t, string(src), "git", "rev-parse", "HEAD")
+
+	// Remove the remote, so the repository can't be cloned again.
+	if err := os.RemoveAll(remote); err != nil {
+		t.Fatal(err)
+	}
+	lastFetched := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(src.Path("HEAD"), lastFetched, lastFetched); err != nil {
+		t.Fatal(err)
+	}
+
+	rename := func(repo, newName api.RepoName) *httptest.ResponseRecorder {
+		t.Helper()
+		body, err := json.Marshal(protocol.RepoRenameRequest{Repo: repo, NewName: newName})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest("POST", "/repo-rename", bytes.NewReader(body)))
+		return rr
+	}
+
+	if rr := rename(repo, newName); rr.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rr.Code, rr.Body.String())
+	}
+	if repoCloned(src) {
+		t.Error("repository is still cloned under its previous name")
+	}
+	if _, err := os.Stat(filepath.Dir(string(src))); !os.IsNotExist(err) {
+		t.Errorf("expected work tree of the previous name to be removed, got %v", err)
+	}
+	if !repoCloned(dst) {
+		t.Fatal("repository is not cloned under its new name")
+	}
+	if got := runCmd(t, string(dst), "git", "rev-parse", "HEAD"); got != want {
+		t.Errorf("got HEAD %q after renaming, want %q", got, want)
+	}
+	if got, err := repoLastFetched(dst); err != nil || !got.Equal(lastFetched) {
+		t.Errorf("got last fetched %v (%v), want %v", got, err, lastFetched)
+	}
+	assertFiles(t, filepath.Dir(string(dst)), "hello.txt")
+
+	// The previous name is gone, and the new name can't be overwritten.
+	if rr := rename(repo, newName); rr.Code != http.StatusNotFound {
+		t.Errorf("got status %d renaming a missing repository, want %d", rr.Code, http.StatusNotFound)
+	}
+	if err := os.MkdirAll(string(src), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	runCmd(t, string(src), "git", "init", "--bare", ".")
+	if rr := rename(repo, newName); rr.Code != http.StatusConflict {
+		t.Errorf("got status %d renaming to an existing repository, want %d", rr.Code, http.StatusConflict)
+	}
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os/exec"
+
+	"github.com/sourcegraph/sourcegraph/internal/api"
+	"github.com/sourcegraph/sourcegraph/internal/gitserver/protocol"
+	log15 "gopkg.in/inconshreveable/log15.v2"
+)
+
+// handleRepoRepack repacks a repository on demand, e.g. after a large push
+// left it bloated. It is refused while the repository is cloned or updated.
+func (s *Server) handleRepoRepack(w http.ResponseWriter, r *http.Request) {
+	var req protocol.RepoRepackRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Repo = protocol.NormalizeRepo(req.Repo)
+	dir := s.dir(req.Repo)
+	if !repoCloned(dir) {
+		http.Error(w, "repository not cloned", http.StatusNotFound)
+		return
+	}
+	if _, cloning := s.locker.Status(dir); cloning {
+		http.Error(w, "repository is being cloned", http.StatusConflict)
+		return
+	}
+
+	unlock, ok := s.lockRepoUpdates(req.Repo)
+	if !ok {
+		http.Error(w, "repository is being updated", http.StatusConflict)
+		return
+	}
+	defer unlock()
+
+	var (
+		resp protocol.RepoRepackResponse
+		err  error
+	)
+	if resp.SizeBefore, err = dirSize(string(dir)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := s.repack(r.Context(), req.Repo, dir, req.Aggressive); err != nil {
+		log15.Error("failed to repack repository", "repo", req.Repo, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if resp.SizeAfter, err = dirSize(string(dir)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log15.Info("repacked repository", "repo", req.Repo, "sizeBefore", resp.SizeBefore, "sizeAfter", resp.SizeAfter)
+
+	if err := json.NewEncoder(w).Encode(&resp); err != nil {
+		log15.Error("failed to encode response", "error", err)
+	}
+}
+
+// lockRepoUpdates prevents updates of repo until unlock is called. ok is
+// false if an update is running.
+func (s *Server) lockRepoUpdates(repo api.RepoName) (unlock func(), ok bool) {
+	s.repoUpdateLocksMu.Lock()
+	l := s.repoUpdateLock(repo)
+	fetching := l.fetching
+	s.repoUpdateLocksMu.Unlock()
+	if fetching {
+		return nil, false
+	}
+	l.mu.Lock()
+	return l.mu.Unlock, true
+}
+
+// repack packs all objects of dir into a single pack and removes the
+// redundant packs and loose objects. If aggressive is true it also runs git
+// gc --aggressive.
+func (s *Server) repack(ctx context.Context, repo api.RepoName, dir GitDir, aggressive bool) error {
+	cmds := [][]string{{"repack", "-A", "-d", "--quiet"}}
+	if aggressive {
+		cmds = append(cmds, []string{"gc", "--aggressive", "--quiet"})
+	}
+	for _, args := range cmds {
+		if err := s.runRepackCommand(ctx, repo, dir, args); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runRepackCommand runs the git subcommand args of repack in dir.
+func (s *Server) runRepackCommand(ctx context.Context, repo api.RepoName, dir GitDir, args []string) error {
+	defer trackRunning(args[0])()
+
+	// Bound the memory used for packing like during clones and fetches.
+	config := append(s.GitMemoryConfig.merge(s.repoOptions(repo).Memory).args(), s.compressionArgs(repo)...)
+	cmd := exec.CommandContext(ctx, "git", append(config, args...)...)
+	cmd.Dir = string(dir)
+	if _, err := cmd.Output(); err != nil {
+		return wrapCmdError(cmd, err)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/sourcegraph/sourcegraph/internal/api"
+	"github.com/sourcegraph/sourcegraph/internal/gitserver/protocol"
+)
+
+func TestServer_handleRepoRepack(t *testing.T) {
+	reposDir, cleanup := tmpDir(t)
+	defer cleanup()
+	s := &Server{ReposDir: reposDir}
+	h := s.Handler()
+
+	origRepoCloned := repoCloned
+	repoCloned = func(dir GitDir) bool { return true }
+	defer func() { repoCloned = origRepoCloned }()
+
+	repo := api.RepoName("example.com/foo/bar")
+	dir := string(s.dir(repo))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	runCmd(t, dir, "git", "init", "--bare", ".")
+
+	// Every commit adds a loose copy of a large file which only differs in a
+	// single line, so repacking stores deltas instead.
+	work, cleanup2 := tmpDir(t)
+	defer cleanup2()
+	runCmd(t, work, "git", "init", ".")
+	var lines []string
+	for i := 0; i < 1000; i++ {
+		lines = append(lines, fmt.Sprintf("line %d of the file", i))
+	}
+	for i := 0; i < 20; i++ {
+		lines[i] = "changed"
+		writeFile(t, work+"/file.txt", []byte(strings.Join(lines, "\n")))
+		runCmd(t, work, "git", "add", "file.txt")
+		runCmd(t, work, "git", "commit", "-m", fmt.Sprintf("commit %d", i))
+		runCmd(t, work, "git", "push", "--quiet", dir, "HEAD:refs/heads/master")
+	}
+
+	repack := func() *httptest.ResponseRecorder {
+		t.Helper()
+		body, err := json.Marshal(protocol.RepoRepackRequest{Repo: repo})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest("POST", "/repo-repack", bytes.NewReader(body)))
+		return rr
+	}
+
+	// The repository must not be repacked while it is being updated.
+	s.repoUpdateLocksMu.Lock()
+	s.repoUpdateLock(repo).fetching = true
+	s.repoUpdateLocksMu.Unlock()
+	if rr := repack(); rr.Code != http.StatusConflict {
+		t.Fatalf("got status %d while updating, want %d: %s", rr.Code, http.StatusConflict, rr.Body.String())
+	}
+	if out := runCmd(t, dir, "git", "count-objects"); strings.HasPrefix(out, "0 objects") {
+		t.Fatalf("repository was repacked while updating: %s", out)
+	}
+	s.repoUpdateLocksMu.Lock()
+	s.repoUpdateLock(repo).fetching = false
+	s.repoUpdateLocksMu.Unlock()
+
+	rr := repack()
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rr.Code, rr.Body.String())
+	}
+	var resp protocol.RepoRepackResponse
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.SizeBefore <= 0 || resp.SizeAfter >= resp.SizeBefore {
+		t.Errorf("got sizes %+v, want a smaller repository after repacking", resp)
+	}
+	if size, err := dirSize(dir); err != nil || size != resp.SizeAfter {
+		t.Errorf("got size %d after repacking (%v), want %d", size, err, resp.SizeAfter)
+	}
+	if out := runCmd(t, dir, "git", "count-objects"); !strings.HasPrefix(out, "0 objects") {
+		t.Errorf("got loose objects after repacking: %s", out)
+	}
+
+	// The update lock is released again.
+	unlock, ok := s.lockRepoUpdates(repo)
+	if !ok {
+		t.Fatal("expected to acquire the update lock after repacking")
+	}
+	unlock()
+}
@@ -1,34 +1,61 @@
 package server
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/sourcegraph/sourcegraph/internal/api"
 	"github.com/sourcegraph/sourcegraph/internal/gitserver/protocol"
 	log15 "gopkg.in/inconshreveable/log15.v2"
 )
 
-func (s *Server) repoInfo(ctx context.Context, repo api.RepoName) (*protocol.RepoInfo, error) {
+// repoInfoDir returns the GIT_DIR repoInfo reports on. Repositories which
+// were not moved from the previous ReposDir yet are cloned, see
+// handleIsRepoCloned. They are reported as found there.
+func (s *Server) repoInfoDir(repo api.RepoName) GitDir {
 	dir := s.dir(repo)
-	resp := protocol.RepoInfo{
-		Cloned: repoCloned(dir),
+	if !repoCloned(dir) && s.inPreviousReposDir(repo) {
+		return s.previousDir(repo)
 	}
+	return dir
+}
+
+func (s *Server) repoInfo(ctx context.Context, repo api.RepoName) (*protocol.RepoInfo, error) {
+	dir := s.dir(repo)
+	resp := protocol.RepoInfo{}
+	resp.CloneProgress, resp.CloneInProgress = s.locker.Status(dir)
+
+	dir = s.repoInfoDir(repo)
+	resp.Cloned = repoCloned(dir)
+	resp.Corrupt = repoCorruption(dir)
 	if resp.Cloned {
 		remoteURL, err := repoRemoteURL(ctx, dir)
 		if err != nil {
-			return nil, err
+			// Git commands are expected to fail in a corrupt repository.
+			// Report the corruption instead of failing the whole request.
+			if resp.Corrupt == "" {
+				return nil, err
+			}
+			log15.Warn("error getting remote URL of corrupt repository", "repo", repo, "err", err)
 		}
 		resp.URL = remoteURL
-	}
-	{
-		resp.CloneProgress, resp.CloneInProgress = s.locker.Status(dir)
-		if isAlwaysCloningTest(repo) {
-			resp.CloneInProgress = true
-			resp.CloneProgress = "This will never finish cloning"
+		resp.Shallow = repoShallow(dir)
+		if resp.Corrupt == "" {
+			if resp.Empty, err = isEmptyRepo(dir); err != nil {
+				log15.Warn("error checking for empty repository", "repo", repo, "err", err)
+			}
 		}
 	}
+	if isAlwaysCloningTest(repo) {
+		resp.CloneInProgress = true
+		resp.CloneProgress = "This will never finish cloning"
+	}
 	if resp.Cloned {
 		if mtime, err := repoLastFetched(dir); err != nil {
 			log15.Warn("error computing last-fetched date", "repo", repo, "err", err)
@@ -47,6 +74,18 @@ func (s *Server) repoInfo(ctx context.Context, repo api.RepoName) (*protocol.Rep
 		} else {
 			resp.LastChanged = &lastChanged
 		}
+
+		if fetchErr, err := repoLastFetchError(dir); err != nil {
+			log15.Warn("error getting last fetch error", "repo", repo, "err", err)
+		} else {
+			resp.LastFetchError = fetchErr
+		}
+
+		if fallback, err := repoFallbackRemote(dir); err != nil {
+			log15.Warn("error getting fallback remote", "repo", repo, "err", err)
+		} else {
+			resp.FallbackRemote = fallback
+		}
 	}
 	return &resp, nil
 }
@@ -70,10 +109,98 @@ func (s *Server) handleRepoInfo(w http.ResponseWriter, r *http.Request) {
 		resp.Results[repoName] = result
 	}
 
-	if err := json.NewEncoder(w).Encode(resp); err != nil {
+	var body bytes.Buffer
+	if err := json.NewEncoder(&body).Encode(resp); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+
+	// Clients poll this endpoint frequently, so we support conditional
+	// requests. The ETag is derived from the response, which only changes
+	// when the state of one of the requested repositories changes.
+	sum := sha256.Sum256(body.Bytes())
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	w.Header().Set("ETag", etag)
+	lastModified, hasLastModified := s.repoInfoLastModified(resp.Results)
+	if hasLastModified {
+		w.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+	if notModified(r, etag, lastModified, hasLastModified) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	_, _ = w.Write(body.Bytes())
+}
+
+// repoInfoFiles are the files of a GIT_DIR which the repo info is derived
+// from, directly or via git.
+var repoInfoFiles = []string{
+	"HEAD",
+	"FETCH_HEAD",
+	"config",
+	"packed-refs",
+	"refs",
+	"shallow",
+	"sg_refhash",
+	fetchErrorFile,
+	fallbackRemoteFile,
+}
+
+// repoInfoLastModified returns the latest modification time of the GIT_DIRs
+// of results and of their repoInfoFiles. The GIT_DIR itself is included
+// since creating or removing one of the files changes its modification time.
+// It returns false if any repository is not cloned or is being cloned, since
+// their state can change without any of the files changing.
+func (s *Server) repoInfoLastModified(results map[api.RepoName]*protocol.RepoInfo) (time.Time, bool) {
+	var last time.Time
+	for repo, info := range results {
+		if !info.Cloned || info.CloneInProgress {
+			return time.Time{}, false
+		}
+		dir := s.repoInfoDir(repo)
+		fi, err := reposFS.Stat(string(dir))
+		if err != nil {
+			return time.Time{}, false
+		}
+		if fi.ModTime().After(last) {
+			last = fi.ModTime()
+		}
+		for _, name := range repoInfoFiles {
+			fi, err := reposFS.Stat(dir.Path(name))
+			if err != nil {
+				continue
+			}
+			if fi.ModTime().After(last) {
+				last = fi.ModTime()
+			}
+		}
+	}
+	return last, len(results) > 0
+}
+
+// notModified reports whether the conditional request r can be answered with
+// 304 Not Modified. As specified by RFC 7232, If-Modified-Since is ignored
+// when the request contains If-None-Match.
+func notModified(r *http.Request, etag string, lastModified time.Time, hasLastModified bool) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == etag || candidate == "*" {
+				return true
+			}
+		}
+		return false
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" && hasLastModified {
+		t, err := http.ParseTime(ims)
+		if err != nil {
+			return false
+		}
+		// HTTP dates have a resolution of one second.
+		return !lastModified.Truncate(time.Second).After(t)
+	}
+	return false
 }
 
 func (s *Server) handleRepoDelete(w http.ResponseWriter, r *http.Request) {
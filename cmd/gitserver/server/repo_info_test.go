@@ -6,7 +6,10 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -126,3 +129,168 @@ func TestServer_handleRepoInfo(t *testing.T) {
 		}
 	})
 }
+
+func TestServer_handleRepoInfo_conditional(t *testing.T) {
+	reposDir, cleanup := tmpDir(t)
+	defer cleanup()
+	s := &Server{ReposDir: reposDir}
+	h := s.Handler()
+
+	origRepoRemoteURL := repoRemoteURL
+	repoRemoteURL = func(context.Context, GitDir) (string, error) { return "u", nil }
+	defer func() { repoRemoteURL = origRepoRemoteURL }()
+
+	repos := []api.RepoName{"x", "y"}
+	for _, repo := range repos {
+		dir := s.dir(repo)
+		if err := os.MkdirAll(string(dir), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		runCmd(t, string(dir), "git", "init", "--bare", "--quiet")
+	}
+
+	do := func(header http.Header) *httptest.ResponseRecorder {
+		body, err := json.Marshal(protocol.RepoInfoRequest{Repos: repos})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest("GET", "/repos", bytes.NewReader(body))
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// The first request records the reclone time in the git config. Set the
+	// modification times of the repositories afterwards.
+	do(nil)
+	lastFetched := time.Date(1988, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, repo := range repos {
+		setModTimes(t, string(s.dir(repo)), lastFetched)
+	}
+
+	first := do(nil)
+	if first.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200", first.Code)
+	}
+	etag := first.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("expected ETag")
+	}
+	if got, want := first.Header().Get("Last-Modified"), "Sat, 02 Jan 1988 03:04:05 GMT"; got != want {
+		t.Fatalf("got Last-Modified %q, want %q", got, want)
+	}
+
+	// Unchanged
+	if rr := do(http.Header{"If-None-Match": {etag}}); rr.Code != http.StatusNotModified || rr.Body.Len() != 0 {
+		t.Errorf("If-None-Match: got status %d with body %q, want 304 without body", rr.Code, rr.Body.String())
+	}
+	if rr := do(http.Header{"If-Modified-Since": {first.Header().Get("Last-Modified")}}); rr.Code != http.StatusNotModified {
+		t.Errorf("If-Modified-Since: got status %d, want 304", rr.Code)
+	}
+
+	// A fetch fails. Failures like network errors leave FETCH_HEAD as it is,
+	// unlike the failure to find the remote here.
+	if err := s.doRepoUpdate(context.Background(), "x", filepath.Join(reposDir, "missing")); err == nil {
+		t.Fatal("expected fetch to fail")
+	}
+	for _, name := range []string{"HEAD", "FETCH_HEAD"} {
+		if err := os.Chtimes(s.dir("x").Path(name), lastFetched, lastFetched); err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+	}
+	rr := do(http.Header{"If-Modified-Since": {first.Header().Get("Last-Modified")}})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("If-Modified-Since after failed fetch: got status %d, want 200", rr.Code)
+	}
+	if !strings.Contains(rr.Body.String(), `"LastFetchError"`) {
+		t.Errorf("expected the failed fetch in the response, got %s", rr.Body.String())
+	}
+	second := rr
+
+	// The repository is fetched again
+	fetchHead := filepath.Join(string(s.dir("y")), "FETCH_HEAD")
+	writeFile(t, fetchHead, nil)
+	if err := os.Chtimes(fetchHead, lastFetched.Add(time.Minute), lastFetched.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	rr = do(http.Header{"If-None-Match": {second.Header().Get("ETag")}})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("If-None-Match after fetch: got status %d, want 200", rr.Code)
+	}
+	if rr.Header().Get("ETag") == second.Header().Get("ETag") {
+		t.Error("expected ETag to change after fetch")
+	}
+	if rr := do(http.Header{"If-Modified-Since": {first.Header().Get("Last-Modified")}}); rr.Code != http.StatusOK {
+		t.Errorf("If-Modified-Since after fetch: got status %d, want 200", rr.Code)
+	}
+}
+
+// setModTimes sets the modification time of dir and everything below it to
+// mtime.
+func setModTimes(t *testing.T, dir string, mtime time.Time) {
+	t.Helper()
+	err := filepath.Walk(dir, func(path string, _ os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Chtimes(path, mtime, mtime)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServer_repoInfo_health(t *testing.T) {
+	reposDir, cleanup := tmpDir(t)
+	defer cleanup()
+	s := &Server{ReposDir: reposDir, locker: &RepositoryLocker{}}
+
+	initEmptyRepo := func(repo api.RepoName) string {
+		dir := string(s.dir(repo))
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			t.Fatal(err)
+		}
+		runCmd(t, dir, "git", "init", "--bare", ".")
+		runCmd(t, dir, "git", "remote", "add", "origin", "https://example.com/"+string(repo))
+		return dir
+	}
+	initRepo := func(repo api.RepoName) string {
+		dir := initEmptyRepo(repo)
+		tree := strings.TrimSpace(runCmd(t, dir, "git", "hash-object", "-t", "tree", "-w", "/dev/null"))
+		commit := strings.TrimSpace(runCmd(t, dir, "git", "commit-tree", "-m", "init", tree))
+		runCmd(t, dir, "git", "update-ref", "HEAD", commit)
+		return dir
+	}
+	initRepo("healthy")
+	initEmptyRepo("empty")
+	writeFile(t, filepath.Join(initRepo("shallow"), "shallow"), []byte("deadbeef\n"))
+	writeFile(t, filepath.Join(initRepo("invalid-head"), "HEAD"), []byte("garbage\n"))
+	if err := os.Remove(filepath.Join(initRepo("missing-head"), "HEAD")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[api.RepoName]protocol.RepoInfo{
+		"healthy":      {Cloned: true, URL: "https://example.com/healthy"},
+		"shallow":      {Cloned: true, URL: "https://example.com/shallow", Shallow: true},
+		"empty":        {Cloned: true, URL: "https://example.com/empty", Empty: true},
+		"invalid-head": {Cloned: true, Corrupt: "invalid HEAD"},
+		"missing-head": {Corrupt: "missing HEAD"},
+		"missing":      {},
+	}
+	for repo, want := range tests {
+		t.Run(string(repo), func(t *testing.T) {
+			got, err := s.repoInfo(context.Background(), repo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Timestamps depend on the fixture, so only compare health.
+			got.LastFetched, got.LastChanged, got.CloneTime = nil, nil, nil
+			if !cmp.Equal(want, *got) {
+				t.Errorf("mismatch (-want +got):\n%s", cmp.Diff(want, *got))
+			}
+		})
+	}
+}
@@ -0,0 +1,30 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+)
+
+// repoFS is the filesystem storing the repositories, as seen by the helpers
+// which inspect a GIT_DIR without running git, e.g. repoCloned and
+// repoLastFetched. It allows storing repositories elsewhere than on a local
+// POSIX filesystem, e.g. in object storage with a local cache. Errors for
+// missing files must satisfy os.IsNotExist.
+type repoFS interface {
+	Stat(name string) (os.FileInfo, error)
+	ReadFile(name string) ([]byte, error)
+	// ReadDir returns the entries of the directory name sorted by name.
+	ReadDir(name string) ([]os.FileInfo, error)
+}
+
+// osFS is the repoFS of the local filesystem.
+type osFS struct{}
+
+func (osFS) Stat(name string) (os.FileInfo, error) { return os.Stat(name) }
+func (osFS) ReadFile(name string) ([]byte, error)  { return ioutil.ReadFile(name) }
+func (osFS) ReadDir(name string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(name)
+}
+
+// reposFS is the repoFS of all repositories.
+var reposFS repoFS = osFS{}
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/sourcegraph/sourcegraph/internal/gitserver/protocol"
+)
+
+// memFS is an in-memory repoFS of regular files. Their parent directories
+// exist implicitly.
+type memFS map[string]memFile
+
+type memFile struct {
+	data    []byte
+	modTime time.Time
+}
+
+func (fs memFS) Stat(name string) (os.FileInfo, error) {
+	name = filepath.Clean(name)
+	if f, ok := fs[name]; ok {
+		return memFileInfo{name: filepath.Base(name), size: int64(len(f.data)), modTime: f.modTime}, nil
+	}
+	for path := range fs {
+		if strings.HasPrefix(path, name+"/") {
+			return memFileInfo{name: filepath.Base(name), dir: true}, nil
+		}
+	}
+	return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+}
+
+func (fs memFS) ReadFile(name string) ([]byte, error) {
+	f, ok := fs[filepath.Clean(name)]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return f.data, nil
+}
+
+func (fs memFS) ReadDir(name string) ([]os.FileInfo, error) {
+	name = filepath.Clean(name)
+	entries := map[string]os.FileInfo{}
+	for path := range fs {
+		if !strings.HasPrefix(path, name+"/") {
+			continue
+		}
+		child := strings.SplitN(strings.TrimPrefix(path, name+"/"), "/", 2)[0]
+		fi, err := fs.Stat(filepath.Join(name, child))
+		if err != nil {
+			return nil, err
+		}
+		entries[child] = fi
+	}
+	if len(entries) == 0 {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	fis := make([]os.FileInfo, 0, len(entries))
+	for _, fi := range entries {
+		fis = append(fis, fi)
+	}
+	sort.Slice(fis, func(i, j int) bool { return fis[i].Name() < fis[j].Name() })
+	return fis, nil
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (fi memFileInfo) Name() string       { return fi.name }
+func (fi memFileInfo) Size() int64        { return fi.size }
+func (fi memFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi memFileInfo) IsDir() bool        { return fi.dir }
+func (fi memFileInfo) Sys() interface{}   { return nil }
+func (fi memFileInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+func TestRepoFS(t *testing.T) {
+	cloned := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	fetched := cloned.Add(time.Hour)
+	changed := cloned.Add(-time.Hour)
+	fs := memFS{
+		"/repos/cloned/.git/HEAD":           {data: []byte("ref: refs/heads/master\n"), modTime: cloned},
+		"/repos/cloned/.git/objects/pack/x": {},
+		"/repos/cloned/.git/refs/heads/x":   {},
+		"/repos/fetched/.git/HEAD":          {data: []byte("ref: refs/heads/master\n"), modTime: cloned},
+		"/repos/fetched/.git/FETCH_HEAD":    {modTime: fetched},
+		"/repos/fetched/.git/sg_refhash":    {modTime: changed},
+		"/repos/fetched/.git/shallow":       {},
+		"/repos/corrupt/.git/config":        {},
+	}
+	defer func(orig repoFS) { reposFS = orig }(reposFS)
+	reposFS = fs
+
+	if !repoCloned("/repos/cloned/.git") || !repoCloned("/repos/fetched/.git") {
+		t.Error("expected repositories to be cloned")
+	}
+	if repoCloned("/repos/missing/.git") || repoCloned("/repos/corrupt/.git") {
+		t.Error("expected repositories without HEAD not to be cloned")
+	}
+
+	// Without FETCH_HEAD the repository was last fetched when it was cloned.
+	if got, err := repoLastFetched("/repos/cloned/.git"); err != nil || !got.Equal(cloned) {
+		t.Errorf("got last fetched %v (%v), want %v", got, err, cloned)
+	}
+	if got, err := repoLastFetched("/repos/fetched/.git"); err != nil || !got.Equal(fetched) {
+		t.Errorf("got last fetched %v (%v), want %v", got, err, fetched)
+	}
+	if _, err := repoLastFetched("/repos/missing/.git"); !os.IsNotExist(err) {
+		t.Errorf("got error %v for a missing repository, want a not exist error", err)
+	}
+
+	if got, err := repoLastChanged("/repos/cloned/.git"); err != nil || !got.Equal(cloned) {
+		t.Errorf("got last changed %v (%v), want %v", got, err, cloned)
+	}
+	if got, err := repoLastChanged("/repos/fetched/.git"); err != nil || !got.Equal(changed) {
+		t.Errorf("got last changed %v (%v), want %v", got, err, changed)
+	}
+
+	if repoShallow("/repos/cloned/.git") || !repoShallow("/repos/fetched/.git") {
+		t.Error("got wrong shallow state")
+	}
+
+	if empty, err := isEmptyRepo("/repos/cloned/.git"); err != nil || empty {
+		t.Errorf("got empty=%v (%v) for a repository with a loose ref", empty, err)
+	}
+	if empty, err := isEmptyRepo("/repos/fetched/.git"); err != nil || !empty {
+		t.Errorf("got empty=%v (%v) for a repository without refs", empty, err)
+	}
+
+	if got := repoCorruption("/repos/cloned/.git"); got != "" {
+		t.Errorf("got corruption %q for a healthy repository", got)
+	}
+	if got := repoCorruption("/repos/corrupt/.git"); got != "missing HEAD" {
+		t.Errorf("got corruption %q, want %q", got, "missing HEAD")
+	}
+	if got := repoCorruption("/repos/missing/.git"); got != "" {
+		t.Errorf("got corruption %q for a missing repository", got)
+	}
+}
+
+func TestRepoFS_repoInfo(t *testing.T) {
+	cloned := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	fetched := cloned.Add(time.Hour)
+	failed := fetched.Add(time.Hour)
+	fs := memFS{
+		"/repos/github.com/foo/bar/.git/HEAD":                  {data: []byte("ref: refs/heads/master\n"), modTime: cloned},
+		"/repos/github.com/foo/bar/.git/FETCH_HEAD":            {modTime: fetched},
+		"/repos/github.com/foo/bar/.git/objects/pack/x":        {},
+		"/repos/github.com/foo/bar/.git/refs/heads/master":     {},
+		"/repos/github.com/foo/bar/.git/shallow":               {},
+		"/repos/github.com/foo/bar/.git/" + fetchErrorFile:     {data: []byte(`{"Category":"network","Message":"timeout","ConsecutiveFailures":2}`), modTime: failed},
+		"/repos/github.com/foo/bar/.git/" + fallbackRemoteFile: {data: []byte("https://mirror.example.com/foo/bar\n")},
+	}
+	defer func(orig repoFS) { reposFS = orig }(reposFS)
+	reposFS = fs
+
+	origRepoRemoteURL := repoRemoteURL
+	repoRemoteURL = func(context.Context, GitDir) (string, error) { return "https://github.com/foo/bar", nil }
+	defer func() { repoRemoteURL = origRepoRemoteURL }()
+
+	s := &Server{ReposDir: "/repos", locker: &RepositoryLocker{}}
+	info, err := s.repoInfo(context.Background(), "github.com/foo/bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The reclone time is stored in the git config, which is read by git.
+	info.CloneTime = nil
+	want := &protocol.RepoInfo{
+		URL:            "https://github.com/foo/bar",
+		Cloned:         true,
+		LastFetched:    &fetched,
+		LastChanged:    &fetched,
+		LastFetchError: &protocol.FetchError{Category: "network", Message: "timeout", ConsecutiveFailures: 2},
+		FallbackRemote: "https://mirror.example.com/foo/bar",
+		Shallow:        true,
+	}
+	if diff := cmp.Diff(want, info); diff != "" {
+		t.Errorf("unexpected repo info (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sourcegraph/sourcegraph/internal/gitserver/protocol"
+)
+
+// requestGitConfigKeys are the git config keys which may be set per request
+// via protocol.GitConfigHeader, in lower case.
+//
+// 🚨 SECURITY: Every key must be safe to set for any caller. Keys which run
+// commands or change where git reads and writes files, e.g. core.sshCommand
+// or core.hooksPath, must never be added. Neither must keys which change
+// where git connects to, e.g. http.proxy, since the URLs of remotes contain
+// credentials.
+var requestGitConfigKeys = map[string]bool{
+	"http.extraheader": true,
+}
+
+// parseRequestGitConfig returns the "-c" arguments for the git config set
+// by protocol.GitConfigHeader in h. It returns an error if a key is not
+// allowed or a value could inject further config.
+func parseRequestGitConfig(h http.Header) ([]string, error) {
+	var args []string
+	for _, kv := range h[http.CanonicalHeaderKey(protocol.GitConfigHeader)] {
+		i := strings.Index(kv, "=")
+		if i < 0 {
+			return nil, errors.Errorf("invalid git config %q, want key=value", kv)
+		}
+		key, value := strings.ToLower(strings.TrimSpace(kv[:i])), kv[i+1:]
+		if !requestGitConfigKeys[key] {
+			return nil, errors.Errorf("git config key %q is not allowed", key)
+		}
+		if strings.ContainsAny(value, "\r\n\x00") {
+			return nil, errors.Errorf("invalid value for git config key %q", key)
+		}
+		args = append(args, "-c", key+"="+value)
+	}
+	return args, nil
+}
+
+type requestGitConfigKey struct{}
+
+// withRequestGitConfig returns a context which passes the "-c" arguments
+// args to the clones and fetches run with it by runWithRemoteOpts.
+func withRequestGitConfig(ctx context.Context, args []string) context.Context {
+	if len(args) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, requestGitConfigKey{}, args)
+}
+
+// requestGitConfig returns the "-c" arguments set by withRequestGitConfig.
+func requestGitConfig(ctx context.Context) []string {
+	args, _ := ctx.Value(requestGitConfigKey{}).([]string)
+	return args
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sourcegraph/sourcegraph/internal/gitserver/protocol"
+)
+
+func TestParseRequestGitConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		values  []string
+		want    []string
+		wantErr bool
+	}{{
+		name: "none",
+	}, {
+		name:   "allowed",
+		values: []string{"http.extraHeader=Authorization: Bearer abc", "HTTP.EXTRAHEADER=X: y"},
+		want:   []string{"-c", "http.extraheader=Authorization: Bearer abc", "-c", "http.extraheader=X: y"},
+	}, {
+		name:   "empty value",
+		values: []string{"http.extraHeader="},
+		want:   []string{"-c", "http.extraheader="},
+	}, {
+		name:    "not allowed",
+		values:  []string{"core.sshCommand=touch /tmp/pwned"},
+		wantErr: true,
+	}, {
+		name:    "proxy",
+		values:  []string{"http.proxy=http://attacker.example.com"},
+		wantErr: true,
+	}, {
+		name:    "subsection",
+		values:  []string{"http.https://example.com.extraHeader=X: y"},
+		wantErr: true,
+	}, {
+		name:    "no value",
+		values:  []string{"http.extraHeader"},
+		wantErr: true,
+	}, {
+		name:    "newline in value",
+		values:  []string{"http.extraHeader=X: y\n[core]\n\tsshCommand = touch /tmp/pwned"},
+		wantErr: true,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := http.Header{}
+			for _, v := range test.values {
+				h.Add(protocol.GitConfigHeader, v)
+			}
+			got, err := parseRequestGitConfig(h)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error %v, want error %v", err, test.wantErr)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestServer_handleIsRepoCloneable_gitConfig(t *testing.T) {
+	var gotArgs []string
+	runCommandMock = func(ctx context.Context, cmd *exec.Cmd) (int, error) {
+		gotArgs = cmd.Args
+		return 0, nil
+	}
+	defer func() { runCommandMock = nil }()
+
+	s := &Server{}
+	h := s.Handler()
+	isCloneable := func(config string) *httptest.ResponseRecorder {
+		t.Helper()
+		body, err := json.Marshal(protocol.IsRepoCloneableRequest{URL: "https://example.com/foo/bar"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest("POST", "/is-repo-cloneable", bytes.NewReader(body))
+		req.Header.Set(protocol.GitConfigHeader, config)
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := isCloneable("http.extraHeader=Authorization: Bearer abc"); rr.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rr.Code, rr.Body.String())
+	}
+	if args := strings.Join(gotArgs, " "); !strings.Contains(args, "-c http.extraheader=Authorization: Bearer abc") {
+		t.Errorf("got args %q, want the git config of the request", args)
+	}
+
+	gotArgs = nil
+	if rr := isCloneable("core.sshCommand=touch /tmp/pwned"); rr.Code != http.StatusBadRequest {
+		t.Fatalf("got status %d for a disallowed key, want %d", rr.Code, http.StatusBadRequest)
+	}
+	if gotArgs != nil {
+		t.Errorf("got command %q for a rejected request", gotArgs)
+	}
+}
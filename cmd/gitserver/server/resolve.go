@@ -0,0 +1,69 @@
+package server
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ValidateHostResolveOverrides returns an error if overrides is not valid
+// for Server.HostResolveOverrides.
+func ValidateHostResolveOverrides(overrides map[string]string) error {
+	for host, ip := range overrides {
+		if _, _, err := splitResolveHost(host); err != nil {
+			return err
+		}
+		if net.ParseIP(ip) == nil {
+			return errors.Errorf("invalid IP address %q for host %s", ip, host)
+		}
+	}
+	return nil
+}
+
+// splitResolveHost splits a key of Server.HostResolveOverrides into the host
+// and the ports it applies to.
+func splitResolveHost(hostport string) (host string, ports []string, err error) {
+	host, ports = hostport, []string{"80", "443"}
+	if i := strings.LastIndex(hostport, ":"); i >= 0 {
+		port, err := strconv.Atoi(hostport[i+1:])
+		if err != nil || port < 1 || port > 65535 {
+			return "", nil, errors.Errorf("invalid port in host %q", hostport)
+		}
+		host, ports = hostport[:i], []string{hostport[i+1:]}
+	}
+	if host == "" || strings.ContainsAny(host, ":/[] \t\r\n") {
+		return "", nil, errors.Errorf("invalid host %q", hostport)
+	}
+	return host, ports, nil
+}
+
+// hostResolveArgs returns the "-c" arguments which make git connect to the
+// IP addresses of s.HostResolveOverrides instead of resolving their hosts.
+// They are passed to curl as CURLOPT_RESOLVE, so they only affect the git
+// process and apply to HTTP and HTTPS remotes.
+func (s *Server) hostResolveArgs() []string {
+	hosts := make([]string, 0, len(s.HostResolveOverrides))
+	for host := range s.HostResolveOverrides {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	var args []string
+	for _, hostport := range hosts {
+		host, ports, err := splitResolveHost(hostport)
+		if err != nil {
+			continue // rejected by ValidateHostResolveOverrides
+		}
+		ip := s.HostResolveOverrides[hostport]
+		if strings.Contains(ip, ":") {
+			ip = "[" + ip + "]"
+		}
+		for _, port := range ports {
+			args = append(args, "-c", "http.curloptResolve="+host+":"+port+":"+ip)
+		}
+	}
+	return args
+}
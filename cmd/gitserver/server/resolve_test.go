@@ -0,0 +1,83 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os/exec"
+	"reflect"
+	"testing"
+)
+
+func TestValidateHostResolveOverrides(t *testing.T) {
+	for _, overrides := range []map[string]string{
+		nil,
+		{"github.com": "10.0.0.1"},
+		{"github.com:8443": "10.0.0.1", "gitlab.com": "::1"},
+	} {
+		if err := ValidateHostResolveOverrides(overrides); err != nil {
+			t.Errorf("unexpected error for %v: %s", overrides, err)
+		}
+	}
+	for _, overrides := range []map[string]string{
+		{"": "10.0.0.1"},
+		{"github.com": "github.com"},
+		{"github.com:http": "10.0.0.1"},
+		{"github.com:0": "10.0.0.1"},
+		{"https://github.com": "10.0.0.1"},
+		{"github.com\nevil": "10.0.0.1"},
+	} {
+		if err := ValidateHostResolveOverrides(overrides); err == nil {
+			t.Errorf("expected error for %v", overrides)
+		}
+	}
+}
+
+func TestServer_hostResolveArgs(t *testing.T) {
+	s := &Server{}
+	if args := s.hostResolveArgs(); args != nil {
+		t.Errorf("got args %q without overrides, want none", args)
+	}
+
+	s.HostResolveOverrides = map[string]string{
+		"github.com":      "10.0.0.1",
+		"gitlab.com:8443": "::1",
+	}
+	want := []string{
+		"-c", "http.curloptResolve=github.com:80:10.0.0.1",
+		"-c", "http.curloptResolve=github.com:443:10.0.0.1",
+		"-c", "http.curloptResolve=gitlab.com:8443:[::1]",
+	}
+	if got := s.hostResolveArgs(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got args %q, want %q", got, want)
+	}
+}
+
+func TestRunWithRemoteOpts_hostResolveOverrides(t *testing.T) {
+	if !gitVersionAtLeast(2, 37) {
+		t.Skip("http.curloptResolve requires git 2.37")
+	}
+	var requested bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = true
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The host doesn't resolve, so git only reaches the server because of
+	// the override.
+	s := &Server{HostResolveOverrides: map[string]string{"gitserver-test.invalid:" + u.Port(): "127.0.0.1"}}
+	cmd := exec.Command("git", "ls-remote", "http://gitserver-test.invalid:"+u.Port()+"/foo/bar")
+	out, err := s.runWithRemoteOpts(context.Background(), cmd, nil)
+	if err == nil {
+		t.Fatal("expected ls-remote of a missing repository to fail")
+	}
+	if !requested {
+		t.Errorf("expected git to connect to the overridden address: %s", out)
+	}
+}
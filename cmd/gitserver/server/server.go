@@ -107,16 +107,136 @@ type Server struct {
 	// ReposDir is the path to the base directory for gitserver storage.
 	ReposDir string
 
+	// PreviousReposDir is the ReposDir used before gitserver storage was
+	// relocated. Its repositories are moved to ReposDir by MigrateRepos, or
+	// on demand when they are cloned. Empty disables the migration.
+	PreviousReposDir string
+
 	// DeleteStaleRepositories when true will delete old repositories when the
 	// Janitor job runs.
 	DeleteStaleRepositories bool
 
+	// CloneWorkTree checks out a work tree next to each clone, in
+	// ${ReposDir}/${name}, for integrations which read files directly. The
+	// work tree is updated after every fetch. The clone itself stays a bare
+	// mirror in ${ReposDir}/${name}/.git.
+	CloneWorkTree bool
+
 	// DesiredPercentFree is the desired percentage of disk space to keep free.
 	DesiredPercentFree int
 
+	// EvictionGracePeriod is how long a repository selected for removal to
+	// free up disk space is kept before it is removed. Accessing the
+	// repository during the grace period cancels its removal. Zero removes
+	// repositories immediately.
+	EvictionGracePeriod time.Duration
+
 	// DiskSizer tells how much disk is free and how large the disk is.
 	DiskSizer DiskSizer
 
+	// GitMemoryConfig bounds the memory used by git when packing objects
+	// during clone and fetch.
+	GitMemoryConfig GitMemoryConfig
+
+	// GitNice is the niceness adjustment (see nice(1)) for git clone and
+	// fetch processes, so background mirroring yields CPU to interactive
+	// traffic. Zero leaves the priority unchanged.
+	GitNice int
+
+	// GitIONiceClass is the IO scheduling class (see ionice(1)) for git clone
+	// and fetch processes: 2 best-effort or 3 idle. Zero leaves the class
+	// unchanged. It is only supported on Linux.
+	GitIONiceClass int
+
+	// GitCompression is the zlib compression level, -1 to 9, passed as
+	// core.compression when cloning, fetching and repacking. It applies to
+	// the objects git writes, e.g. when packing them during gc --auto or
+	// repacks; the compression of the packs sent by the remote is chosen by
+	// the remote. Lower levels trade disk space for CPU. Empty uses git's
+	// default.
+	GitCompression string
+
+	// GitHooksDir is an absolute path to a directory of git hooks, passed
+	// as core.hooksPath when cloning and fetching. Empty uses the hooks of
+	// each repository.
+	GitHooksDir string
+
+	// PostFetchCommand is an absolute path to an executable which is run
+	// after every successful fetch, e.g. to trigger indexing. It runs in
+	// the GIT_DIR with only PATH, SRC_REPO_NAME and SRC_REPO_DIR (the
+	// GIT_DIR) set. Its failures are logged, but don't fail the fetch.
+	// Empty runs nothing.
+	PostFetchCommand string
+
+	// GitUserAgent is passed as http.userAgent when cloning and fetching
+	// over HTTP, so code hosts can identify gitserver. Empty uses git's
+	// default user agent.
+	GitUserAgent string
+
+	// GitUserAgentOverrides maps URL prefixes, e.g. "https://github.com", to
+	// the user agent used for matching remotes instead of GitUserAgent. It
+	// is passed as git's http.<url>.userAgent, so the same URL matching
+	// rules apply.
+	GitUserAgentOverrides map[string]string
+
+	// HostResolveOverrides maps hosts of remotes to the IP address git
+	// connects to instead of resolving them, e.g. to bypass broken DNS. A
+	// host without a port, e.g. "github.com", applies to ports 80 and 443.
+	// Only HTTP and HTTPS remotes are affected, and it requires git 2.37
+	// (older versions ignore it).
+	HostResolveOverrides map[string]string
+
+	// RepoOptions overrides git options for specific repositories. Keys are
+	// normalized repository names (see protocol.NormalizeRepo).
+	RepoOptions map[api.RepoName]RepoOptions
+
+	// FetchValidators are run against every fetch before its objects and
+	// refs become visible in the repository. When empty and MaxFetchSize is
+	// zero, fetches go directly into the repository.
+	FetchValidators []FetchValidator
+
+	// MaxFetchSize is the maximum number of bytes of objects a fetch may
+	// add to a repository. Fetches are quarantined if it is set, so a fetch
+	// exceeding it is rejected before any of its objects and refs become
+	// visible in the repository. Clones are not limited. Zero disables the
+	// limit.
+	MaxFetchSize int64
+
+	// FetchNegotiationSkipping makes fetches use git's skipping negotiation
+	// algorithm with only branches as negotiation tips, which reduces
+	// negotiation round-trips for large, active repositories. It is ignored
+	// if git is older than 2.19.
+	FetchNegotiationSkipping bool
+
+	// GzipResponses compresses the output of exec requests for clients which
+	// accept gzip, unless the output is already compressed.
+	GzipResponses bool
+
+	// ExecIdleTimeout is how long writing the response of an exec request
+	// may make no progress before the client is considered gone, the
+	// command is cancelled and the connection closed (see ConnContext).
+	// Zero disables it.
+	ExecIdleTimeout time.Duration
+
+	// FetchBreakerThreshold is the number of consecutive network failures
+	// of clones and fetches from a code host after which further clones and
+	// fetches from it fail fast for FetchBreakerCooldown. Zero disables the
+	// circuit breaker.
+	FetchBreakerThreshold int
+
+	// FetchBreakerCooldown is how long clones and fetches from a code host
+	// fail fast once FetchBreakerThreshold is reached. Afterwards a single
+	// fetch tests whether the host recovered.
+	FetchBreakerCooldown time.Duration
+
+	// StorageCloneLimits maps directories in ReposDir which are on separate
+	// storage devices, e.g. a volume mounted at "github.com", to the number
+	// of concurrent clones and fetches of the repositories below them, so
+	// each device is used independently. Their clones use a temporary
+	// directory on the same device. Other repositories share the limit of
+	// the ReposDir device (GitMaxConcurrentClones).
+	StorageCloneLimits map[string]int
+
 	// skipCloneForTests is set by tests to avoid clones.
 	skipCloneForTests bool
 
@@ -137,13 +257,63 @@ type Server struct {
 	cloneLimiter     *mutablelimiter.Limiter
 	cloneableLimiter *mutablelimiter.Limiter
 
+	// storageLimiters are the clone limiters of StorageCloneLimits, keyed by
+	// absolute directory. They are created on first use.
+	storageLimitersMu sync.Mutex
+	storageLimiters   map[string]*mutablelimiter.Limiter
+
 	repoUpdateLocksMu sync.Mutex // protects the map below and also updates to locks.once
 	repoUpdateLocks   map[api.RepoName]*locks
+
+	// fetchBreakers tracks failing code hosts, see FetchBreakerThreshold.
+	fetchBreakers hostBreakers
 }
 
 type locks struct {
 	once *sync.Once  // consolidates multiple waiting updates
 	mu   *sync.Mutex // prevents updates running in parallel
+
+	// fetching is whether an update is running. It is protected by
+	// Server.repoUpdateLocksMu.
+	fetching bool
+}
+
+// repoUpdateLock returns the locks serializing updates of repo. The caller
+// must hold s.repoUpdateLocksMu.
+func (s *Server) repoUpdateLock(repo api.RepoName) *locks {
+	l, ok := s.repoUpdateLocks[repo]
+	if !ok {
+		l = &locks{
+			once: new(sync.Once),
+			mu:   new(sync.Mutex),
+		}
+		s.repoUpdateLocks[repo] = l
+	}
+	return l
+}
+
+// withRepoUpdateLock runs fn holding the update lock of repo, so it does not
+// run concurrently with other updates. While fn runs, the locks of repo are
+// marked as fetching. fn is passed the locks of repo.
+func (s *Server) withRepoUpdateLock(repo api.RepoName, fn func(l *locks) error) error {
+	s.repoUpdateLocksMu.Lock()
+	l := s.repoUpdateLock(repo)
+	mu := l.mu
+	s.repoUpdateLocksMu.Unlock()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	s.repoUpdateLocksMu.Lock()
+	l.fetching = true
+	s.repoUpdateLocksMu.Unlock()
+	defer func() {
+		s.repoUpdateLocksMu.Lock()
+		l.fetching = false
+		s.repoUpdateLocksMu.Unlock()
+	}()
+
+	return fn(l)
 }
 
 // shortGitCommandTimeout returns the timeout for git commands that should not
@@ -225,6 +395,7 @@ func (s *Server) Handler() http.Handler {
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/archive", s.handleArchive)
+	mux.HandleFunc("/capabilities", s.handleCapabilities)
 	mux.HandleFunc("/exec", s.handleExec)
 	mux.HandleFunc("/list", s.handleList)
 	mux.HandleFunc("/list-gitolite", s.handleListGitolite)
@@ -232,6 +403,9 @@ func (s *Server) Handler() http.Handler {
 	mux.HandleFunc("/is-repo-cloned", s.handleIsRepoCloned)
 	mux.HandleFunc("/repos", s.handleRepoInfo)
 	mux.HandleFunc("/delete", s.handleRepoDelete)
+	mux.HandleFunc("/repo-refs-check", s.handleRepoRefsCheck)
+	mux.HandleFunc("/repo-repack", s.handleRepoRepack)
+	mux.HandleFunc("/repo-rename", s.handleRepoRename)
 	mux.HandleFunc("/repo-update", s.handleRepoUpdate)
 	mux.HandleFunc("/getGitolitePhabricatorMetadata", s.handleGetGitolitePhabricatorMetadata)
 	mux.HandleFunc("/create-commit-from-patch", s.handleCreateCommitFromPatch)
@@ -285,11 +459,11 @@ func (s *Server) serverContext() (context.Context, context.CancelFunc) {
 }
 
 // acquireCloneLimiter() acquires a cancellable context associated with the
-// clone limiter.
-func (s *Server) acquireCloneLimiter(ctx context.Context) (context.Context, context.CancelFunc, error) {
+// clone limiter of the storage device of dir.
+func (s *Server) acquireCloneLimiter(ctx context.Context, dir GitDir) (context.Context, context.CancelFunc, error) {
 	cloneQueue.Inc()
 	defer cloneQueue.Dec()
-	return s.cloneLimiter.Acquire(ctx)
+	return s.cloneLimiterFor(dir).Acquire(ctx)
 }
 
 // queryCloneLimiter reports the capacity and length of the clone limiter's queue
@@ -320,9 +494,16 @@ func (s *Server) tempDir(prefix string) (name string, err error) {
 }
 
 func (s *Server) ignorePath(path string) bool {
-	// We ignore any path which starts with .tmp in ReposDir
-	if filepath.Dir(path) != s.ReposDir {
-		return false
+	return s.ignorePathIn(s.ReposDir, path)
+}
+
+// ignorePathIn is like ignorePath for the paths in root, which is
+// s.ReposDir or s.PreviousReposDir.
+func (s *Server) ignorePathIn(root, path string) bool {
+	// We ignore any path which starts with .tmp in root or in the
+	// directories of other storage devices.
+	if filepath.Dir(path) != root {
+		return s.isStorageTempDir(root, path)
 	}
 	return strings.HasPrefix(filepath.Base(path), tempDirName)
 }
@@ -333,6 +514,12 @@ func (s *Server) handleIsRepoCloneable(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	config, err := parseRequestGitConfig(r.Header)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ctx := withRequestGitConfig(r.Context(), config)
 
 	if req.URL == "" {
 		if req.Repo == "" {
@@ -342,8 +529,7 @@ func (s *Server) handleIsRepoCloneable(w http.ResponseWriter, r *http.Request) {
 
 		// BACKCOMPAT: Determine URL from the existing repo on disk if the client didn't send it.
 		dir := s.dir(req.Repo)
-		var err error
-		req.URL, err = repoRemoteURL(r.Context(), dir)
+		req.URL, err = repoRemoteURL(ctx, dir)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -351,7 +537,7 @@ func (s *Server) handleIsRepoCloneable(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var resp protocol.IsRepoCloneableResponse
-	if err := s.isCloneable(r.Context(), req.URL); err == nil {
+	if err := s.isCloneable(ctx, req.URL); err == nil {
 		resp = protocol.IsRepoCloneableResponse{Cloneable: true}
 	} else {
 		resp = protocol.IsRepoCloneableResponse{
@@ -372,7 +558,7 @@ func (s *Server) handleIsRepoCloned(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	if repoCloned(s.dir(req.Repo)) {
+	if repoCloned(s.dir(req.Repo)) || s.inPreviousReposDir(req.Repo) {
 		w.WriteHeader(http.StatusOK)
 	} else {
 		w.WriteHeader(http.StatusNotFound)
@@ -389,6 +575,11 @@ func (s *Server) handleRepoUpdate(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	config, err := parseRequestGitConfig(r.Header)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	var resp protocol.RepoUpdateResponse
 	req.Repo = protocol.NormalizeRepo(req.Repo)
 	dir := s.dir(req.Repo)
@@ -397,6 +588,7 @@ func (s *Server) handleRepoUpdate(w http.ResponseWriter, r *http.Request) {
 	// cancel the git commands partway through if the request terminates.
 	ctx, cancel1 := s.serverContext()
 	defer cancel1()
+	ctx = withRequestGitConfig(ctx, config)
 	ctx, cancel2 := context.WithTimeout(ctx, longGitCommandTimeout)
 	defer cancel2()
 	resp.QueueCap, resp.QueueLen = s.queryCloneLimiter()
@@ -413,7 +605,9 @@ func (s *Server) handleRepoUpdate(w http.ResponseWriter, r *http.Request) {
 		resp.Cloned = true
 		var statusErr, updateErr error
 
-		if debounce(req.Repo, req.Since) {
+		if req.Commit != "" {
+			updateErr = s.fetchCommit(ctx, req.Repo, req.URL, req.Commit)
+		} else if debounce(req.Repo, req.Since) {
 			updateErr = s.doRepoUpdate(ctx, req.Repo, req.URL)
 		}
 
@@ -510,16 +704,29 @@ func (s *Server) handleExec(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) exec(w http.ResponseWriter, r *http.Request, req *protocol.ExecRequest) {
+	if s.GzipResponses && acceptsGzip(r) {
+		gw := newGzipResponseWriter(w)
+		w = gw
+		defer gw.Close()
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), shortGitCommandTimeout(req.Args))
+	defer cancel()
+
 	// Flush writes more aggressively than standard net/http so that clients
 	// with a context deadline see as much partial response body as possible.
-	if fw := newFlushingResponseWriter(w); fw != nil {
+	// If the client stops reading, the command is cancelled and the
+	// connection closed. The latter unblocks the write of the command's
+	// output, which exec.Cmd.Wait waits for.
+	onStall := func() {
+		cancel()
+		closeConn(r)
+	}
+	if fw := newFlushingResponseWriter(w, s.ExecIdleTimeout, onStall); fw != nil {
 		w = fw
 		defer fw.Close()
 	}
 
-	ctx, cancel := context.WithTimeout(r.Context(), shortGitCommandTimeout(req.Args))
-	defer cancel()
-
 	start := time.Now()
 	var cmdStart time.Time // set once we have ensured commit
 	exitStatus := -10810   // sentinel value to indicate not set
@@ -614,7 +821,7 @@ func (s *Server) exec(w http.ResponseWriter, r *http.Request, req *protocol.Exec
 		return
 	}
 	if !repoCloned(dir) {
-		if req.URL == "" {
+		if req.URL == "" && !s.inPreviousReposDir(req.Repo) {
 			status = "repo-not-found"
 			w.WriteHeader(http.StatusNotFound)
 			_ = json.NewEncoder(w).Encode(&protocol.NotFoundPayload{CloneInProgress: false})
@@ -637,6 +844,8 @@ func (s *Server) exec(w http.ResponseWriter, r *http.Request, req *protocol.Exec
 		return
 	}
 
+	s.cancelEviction(dir)
+
 	didUpdate := s.ensureRevision(ctx, req.Repo, req.URL, req.EnsureRevision, dir)
 	if didUpdate {
 		ensureRevisionStatus = "fetched"
@@ -738,6 +947,25 @@ func (s *Server) cloneRepo(ctx context.Context, repo api.RepoName, url string, o
 		return progress, nil
 	}
 
+	// Repositories which were not moved from the previous ReposDir yet are
+	// moved rather than cloned again.
+	if s.inPreviousReposDir(repo) {
+		if opts != nil && opts.Block {
+			if _, err := s.migrateRepo(ctx, repo); err != nil {
+				return "", errors.Wrapf(err, "failed to migrate %s", repo)
+			}
+			return "", nil
+		}
+		go func() {
+			ctx, cancel := s.serverContext()
+			defer cancel()
+			if _, err := s.migrateRepo(ctx, repo); err != nil {
+				log15.Error("failed to migrate repo", "repo", repo, "error", err)
+			}
+		}()
+		return "migrating repository", nil
+	}
+
 	// isCloneable causes a network request, so we limit the number that can
 	// run at one time. We use a separate semaphore to cloning since these
 	// checks being blocked by a few slow clones will lead to poor feedback to
@@ -773,7 +1001,7 @@ func (s *Server) cloneRepo(ctx context.Context, repo api.RepoName, url string, o
 	doClone := func(ctx context.Context) error {
 		defer lock.Release()
 
-		ctx, cancel1, err := s.acquireCloneLimiter(ctx)
+		ctx, cancel1, err := s.acquireCloneLimiter(ctx, dir)
 		if err != nil {
 			return err
 		}
@@ -795,7 +1023,7 @@ func (s *Server) cloneRepo(ctx context.Context, repo api.RepoName, url string, o
 			}
 		}
 
-		tmpPath, err := s.tempDir("clone-")
+		tmpPath, err := s.tempDirFor(dir, "clone-")
 		if err != nil {
 			return err
 		}
@@ -803,14 +1031,21 @@ func (s *Server) cloneRepo(ctx context.Context, repo api.RepoName, url string, o
 		tmpPath = filepath.Join(tmpPath, ".git")
 		tmp := GitDir(tmpPath)
 
-		cmd := exec.CommandContext(ctx, "git", "clone", "--mirror", "--progress", url, tmpPath)
+		args := append(s.remoteGitConfigArgs(repo), "clone", "--mirror", "--progress", s.remoteURL(repo, url), tmpPath)
+		cmd := exec.CommandContext(ctx, "git", args...)
 		log15.Info("cloning repo", "repo", repo, "tmp", tmpPath, "dst", dstPath)
 
+		if err := s.allowFetch(url); err != nil {
+			return err
+		}
+
 		pr, pw := io.Pipe()
 		defer pw.Close()
 		go readCloneProgress(url, lock, pr)
 
-		if output, err := runWithRemoteOpts(ctx, cmd, pw); err != nil {
+		output, err := s.runWithRemoteOpts(ctx, cmd, pw)
+		s.fetchDone(url, output, err)
+		if err != nil {
 			return errors.Wrapf(err, "clone failed. Output: %s", string(output))
 		}
 
@@ -840,6 +1075,9 @@ func (s *Server) cloneRepo(ctx context.Context, repo api.RepoName, url string, o
 		if err := renameAndSync(tmpPath, dstPath); err != nil {
 			return err
 		}
+		if err := s.updateWorkTree(ctx, repo, dir); err != nil {
+			return errors.Wrap(err, "failed to check out work tree")
+		}
 
 		log15.Info("repo cloned", "repo", repo)
 		repoClonedCounter.Inc()
@@ -855,10 +1093,12 @@ func (s *Server) cloneRepo(ctx context.Context, repo api.RepoName, url string, o
 		return "", nil
 	}
 
+	config := requestGitConfig(ctx)
 	go func() {
 		// Create a new context because this is in a background goroutine.
 		ctx, cancel := s.serverContext()
 		defer cancel()
+		ctx = withRequestGitConfig(ctx, config)
 		if err := doClone(ctx); err != nil {
 			log15.Error("failed to clone repo", "repo", repo, "error", err)
 		}
@@ -912,7 +1152,9 @@ func newURLRedactor(rawurl string) *urlRedactor {
 			sensitive = append(sensitive, u)
 		}
 	}
-	sensitive = append(sensitive, rawurl)
+	if rawurl != "" {
+		sensitive = append(sensitive, rawurl)
+	}
 	return &urlRedactor{sensitive: sensitive}
 }
 
@@ -969,7 +1211,7 @@ func (s *Server) isCloneable(ctx context.Context, url string) error {
 	}
 
 	cmd := exec.CommandContext(ctx, "git", args...)
-	out, err := runWithRemoteOpts(ctx, cmd, nil)
+	out, err := s.runWithRemoteOpts(ctx, cmd, nil)
 	if err != nil {
 		if ctxerr := ctx.Err(); ctxerr != nil {
 			err = ctxerr
@@ -1024,6 +1266,29 @@ func init() {
 	prometheus.MustRegister(repoClonedCounter)
 }
 
+// fetchFrom fetches refspecs of repo from url into dir.
+func (s *Server) fetchFrom(ctx context.Context, repo api.RepoName, dir GitDir, url string, refspecs []string) (output []byte, err error) {
+	if err := s.allowFetch(url); err != nil {
+		return nil, err
+	}
+
+	// Log each line of output of the fetch with the repository as context.
+	outputLog := newLogLineWriter(log15.New("repo", repo, "cmd", "fetch").Debug, newURLRedactor(url))
+	if len(s.FetchValidators) > 0 || s.maxFetchSize(repo) > 0 {
+		output, err = s.fetchQuarantined(ctx, repo, dir, s.remoteURL(repo, url), refspecs, outputLog)
+	} else {
+		cmd := exec.CommandContext(ctx, "git", s.fetchArgs(repo, s.remoteURL(repo, url), refspecs)...)
+		cmd.Dir = string(dir)
+		output, err = s.runWithRemoteOpts(ctx, cmd, outputLog)
+	}
+	outputLog.Close()
+	s.fetchDone(url, output, err)
+	if err == nil {
+		s.runPostFetchCommand(ctx, repo, dir)
+	}
+	return output, err
+}
+
 var headBranchPattern = lazyregexp.New(`HEAD branch: (.+?)\n`)
 
 func (s *Server) doRepoUpdate(ctx context.Context, repo api.RepoName, url string) error {
@@ -1033,34 +1298,29 @@ func (s *Server) doRepoUpdate(ctx context.Context, repo api.RepoName, url string
 	defer span.Finish()
 
 	s.repoUpdateLocksMu.Lock()
-	l, ok := s.repoUpdateLocks[repo]
-	if !ok {
-		l = &locks{
-			once: new(sync.Once),
-			mu:   new(sync.Mutex),
-		}
-		s.repoUpdateLocks[repo] = l
-	}
-	once := l.once
-	mu := l.mu
+	once := s.repoUpdateLock(repo).once
 	s.repoUpdateLocksMu.Unlock()
 
 	// doRepoUpdate2 can block longer than our context deadline. done will
 	// close when its done. We can return when either done is closed or our
 	// deadline has passed.
+	// An update which is already in progress is shared, so the git config
+	// of this request only applies if it starts the update.
+	config := requestGitConfig(ctx)
 	done := make(chan struct{})
 	err := errors.New("another operation is already in progress")
 	go func() {
 		defer close(done)
 		once.Do(func() {
-			mu.Lock() // Prevent multiple updates in parallel. It works fine, but it wastes resources.
-			defer mu.Unlock()
-
-			s.repoUpdateLocksMu.Lock()
-			l.once = new(sync.Once) // Make new requests wait for next update.
-			s.repoUpdateLocksMu.Unlock()
-
-			err = s.doRepoUpdate2(repo, url)
+			// Prevent multiple updates in parallel. It works fine, but it
+			// wastes resources.
+			err = s.withRepoUpdateLock(repo, func(l *locks) error {
+				s.repoUpdateLocksMu.Lock()
+				l.once = new(sync.Once) // Make new requests wait for next update.
+				s.repoUpdateLocksMu.Unlock()
+
+				return s.doRepoUpdate2(repo, url, config)
+			})
 		})
 	}()
 
@@ -1233,20 +1493,21 @@ func computeRefHash(dir GitDir) ([]byte, error) {
 	return hash, nil
 }
 
-func (s *Server) doRepoUpdate2(repo api.RepoName, url string) error {
+func (s *Server) doRepoUpdate2(repo api.RepoName, url string, config []string) error {
 	// background context.
 	ctx, cancel1 := s.serverContext()
 	defer cancel1()
+	ctx = withRequestGitConfig(ctx, config)
+
+	repo = protocol.NormalizeRepo(repo)
+	dir := s.dir(repo)
 
-	ctx, cancel2, err := s.acquireCloneLimiter(ctx)
+	ctx, cancel2, err := s.acquireCloneLimiter(ctx, dir)
 	if err != nil {
 		return err
 	}
 	defer cancel2()
 
-	repo = protocol.NormalizeRepo(repo)
-	dir := s.dir(repo)
-
 	// If URL is not set, we can also use the last known working URL (set as the remote origin).
 	var urlIsGitRemote bool
 	if url == "" {
@@ -1281,8 +1542,7 @@ func (s *Server) doRepoUpdate2(repo api.RepoName, url string) error {
 		}
 	}
 
-	cmd := exec.CommandContext(ctx, "git", "fetch", "--prune", url, "+refs/heads/*:refs/heads/*", "+refs/tags/*:refs/tags/*", "+refs/pull/*:refs/pull/*")
-	cmd.Dir = string(dir)
+	refspecs := s.fetchRefspecs(repo)
 
 	// drop temporary pack files after a fetch. this function won't
 	// return until this fetch has completed or definitely-failed,
@@ -1290,11 +1550,39 @@ func (s *Server) doRepoUpdate2(repo api.RepoName, url string) error {
 	// when the cleanup happens, just that it does.
 	defer s.cleanTmpFiles(dir)
 
-	if output, err := runWithRemoteOpts(ctx, cmd, nil); err != nil {
+	// Try the fallback remotes in order if the primary is unreachable.
+	remotes := append([]string{url}, s.repoOptions(repo).FallbackURLs...)
+	var output []byte
+	for i, remote := range remotes {
+		url = remote
+		output, err = s.fetchFrom(ctx, repo, dir, url, refspecs)
+		if err == nil || i == len(remotes)-1 || !shouldFallBack(output, err) {
+			break
+		}
+		// 🚨 SECURITY: The output could include the remote url with may contain a sensitive token.
+		log15.Warn("Failed to update, trying fallback remote", "repo", repo, "error", newURLRedactor(url).redact(err.Error()), "fallback", i+1)
+	}
+	if err != nil {
 		log15.Error("Failed to update", "repo", repo, "error", err, "output", string(output))
+		// 🚨 SECURITY: The output could include the remote url with may contain a sensitive token.
+		redacted := newURLRedactor(url).redact(string(output))
+		if err := recordFetchError(dir, []byte(redacted), time.Now()); err != nil {
+			log15.Warn("Failed to record fetch error", "repo", repo, "error", err)
+		}
 		return errors.Wrap(err, "failed to update")
 	}
 
+	if err := clearFetchError(dir); err != nil {
+		log15.Warn("Failed to clear fetch error", "repo", repo, "error", err)
+	}
+	var fallback string
+	if url != remotes[0] {
+		fallback = url
+	}
+	if err := setFallbackRemote(dir, fallback); err != nil {
+		log15.Warn("Failed to record fallback remote", "repo", repo, "error", err)
+	}
+
 	removeBadRefs(ctx, dir)
 
 	// Update the last-changed stamp.
@@ -1305,9 +1593,9 @@ func (s *Server) doRepoUpdate2(repo api.RepoName, url string) error {
 	headBranch := "master"
 
 	// try to fetch HEAD from origin
-	cmd = exec.CommandContext(ctx, "git", "remote", "show", url)
+	cmd := exec.CommandContext(ctx, "git", "remote", "show", s.remoteURL(repo, url))
 	cmd.Dir = path.Join(s.ReposDir, string(repo))
-	output, err := runWithRemoteOpts(ctx, cmd, nil)
+	output, err = s.runWithRemoteOpts(ctx, cmd, nil)
 	if err != nil {
 		log15.Error("Failed to fetch remote info", "repo", repo, "error", err, "output", string(output))
 		return errors.Wrap(err, "failed to fetch remote info")
@@ -1346,6 +1634,11 @@ func (s *Server) doRepoUpdate2(repo api.RepoName, url string) error {
 		log15.Error("Failed to set HEAD", "repo", repo, "error", err, "output", string(output))
 		return errors.Wrap(err, "Failed to set HEAD")
 	}
+
+	if err := s.updateWorkTree(ctx, repo, dir); err != nil {
+		log15.Error("Failed to update work tree", "repo", repo, "error", err)
+		return errors.Wrap(err, "failed to update work tree")
+	}
 	return nil
 }
 
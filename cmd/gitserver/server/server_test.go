@@ -2,11 +2,14 @@ package server
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -105,9 +108,11 @@ func TestRequest(t *testing.T) {
 	s := &Server{ReposDir: "/testroot", skipCloneForTests: true}
 	h := s.Handler()
 
+	origRepoCloned := repoCloned
 	repoCloned = func(dir GitDir) bool {
 		return dir == s.dir("github.com/gorilla/mux") || dir == s.dir("my-mux")
 	}
+	defer func() { repoCloned = origRepoCloned }()
 
 	testRepoExists = func(ctx context.Context, url string) error {
 		if url == "https://github.com/nicksnyder/go-i18n.git" {
@@ -159,6 +164,97 @@ func TestRequest(t *testing.T) {
 	}
 }
 
+func TestRequest_gzip(t *testing.T) {
+	s := &Server{ReposDir: "/testroot", skipCloneForTests: true, GzipResponses: true}
+	h := s.Handler()
+
+	origRepoCloned := repoCloned
+	repoCloned = func(dir GitDir) bool { return true }
+	defer func() { repoCloned = origRepoCloned }()
+	runCommandMock = func(ctx context.Context, cmd *exec.Cmd) (int, error) {
+		cmd.Stdout.Write([]byte("teststdout"))
+		return 42, nil
+	}
+	defer func() { runCommandMock = nil }()
+
+	for _, acceptGzip := range []bool{false, true} {
+		t.Run(fmt.Sprintf("acceptGzip=%v", acceptGzip), func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/exec", strings.NewReader(`{"repo": "github.com/gorilla/mux", "args": ["testcommand"]}`))
+			if acceptGzip {
+				req.Header.Set("Accept-Encoding", "gzip")
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			res := w.Result()
+			var body io.Reader = res.Body
+			if got := res.Header.Get("Content-Encoding"); acceptGzip != (got == "gzip") {
+				t.Fatalf("got Content-Encoding %q", got)
+			}
+			if acceptGzip {
+				zr, err := gzip.NewReader(res.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body = zr
+			}
+			b, err := ioutil.ReadAll(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != "teststdout" {
+				t.Errorf("got body %q, want %q", b, "teststdout")
+			}
+			if got := res.Trailer.Get("X-Exec-Exit-Status"); got != "42" {
+				t.Errorf("got exit status trailer %q, want 42", got)
+			}
+		})
+	}
+}
+
+func TestRequest_stalledClient(t *testing.T) {
+	s := &Server{ReposDir: "/testroot", skipCloneForTests: true, ExecIdleTimeout: 100 * time.Millisecond}
+	h := s.Handler()
+
+	origRepoCloned := repoCloned
+	repoCloned = func(dir GitDir) bool { return true }
+	defer func() { repoCloned = origRepoCloned }()
+	runCommandMock = func(ctx context.Context, cmd *exec.Cmd) (int, error) {
+		// A command with endless output, whose copying to the client blocks
+		// exec.Cmd.Wait until the write to the client fails.
+		yes := exec.CommandContext(ctx, "yes")
+		yes.Stdout = cmd.Stdout
+		return 0, yes.Run()
+	}
+	defer func() { runCommandMock = nil }()
+
+	handlerDone := make(chan struct{})
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(handlerDone)
+		h.ServeHTTP(w, r)
+	}))
+	ts.Config.ConnContext = ConnContext
+	ts.Start()
+	defer ts.Close()
+
+	// The client sends an exec request, but never reads the response.
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	body := `{"repo": "github.com/gorilla/mux", "args": ["testcommand"]}`
+	if _, err := fmt.Fprintf(conn, "POST /exec HTTP/1.1\r\nHost: gitserver\r\nContent-Length: %d\r\n\r\n%s", len(body), body); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-handlerDone:
+	case <-time.After(10 * time.Second):
+		t.Fatal("exec handler did not return for a client which stopped reading")
+	}
+}
+
 func BenchmarkQuickRevParseHead_packed_refs(b *testing.B) {
 	tmp, err := ioutil.TempDir("", "gitserver_test")
 	if err != nil {
@@ -48,3 +48,24 @@ func (s *Server) RegisterMetrics() {
 	})
 	prometheus.MustRegister(c)
 }
+
+// gitOperationsRunning is the number of clones, fetches and repacks which are
+// currently running, by operation.
+var gitOperationsRunning = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "src",
+	Subsystem: "gitserver",
+	Name:      "git_operations_running",
+	Help:      "number of git clone, fetch, repack and gc operations running concurrently.",
+}, []string{"op"})
+
+func init() {
+	prometheus.MustRegister(gitOperationsRunning)
+}
+
+// trackRunning counts op as running until done is called. done must be
+// deferred, so that the count never leaks if the operation fails or panics.
+func trackRunning(op string) (done func()) {
+	g := gitOperationsRunning.WithLabelValues(op)
+	g.Inc()
+	return g.Dec
+}
@@ -2,23 +2,30 @@ package server
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"reflect"
+	"runtime"
+	"runtime/debug"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/sourcegraph/sourcegraph/internal/api"
 	"github.com/sourcegraph/sourcegraph/internal/gitserver/protocol"
+	"github.com/sourcegraph/sourcegraph/internal/vcs/git"
 	log15 "gopkg.in/inconshreveable/log15.v2"
 )
 
@@ -62,21 +69,33 @@ func checkSpecArgSafety(spec string) error {
 
 // runWithRemoteOpts runs the command after applying the remote options.
 // If progress is not nil, all output is written to it in a separate goroutine.
-func runWithRemoteOpts(ctx context.Context, cmd *exec.Cmd, progress io.Writer) ([]byte, error) {
+func (s *Server) runWithRemoteOpts(ctx context.Context, cmd *exec.Cmd, progress io.Writer) ([]byte, error) {
+	subcommand := gitSubcommand(cmd.Args)
 	configureGitCommand(cmd)
+	if config := append(s.hostResolveArgs(), requestGitConfig(ctx)...); len(config) > 0 {
+		cmd.Args = append(cmd.Args[:1], append(config, cmd.Args[1:]...)...)
+	}
+	if subcommand == "clone" || subcommand == "fetch" {
+		s.setBackgroundPriority(cmd)
+		defer trackRunning(subcommand)()
+	}
 
 	var b interface {
 		Bytes() []byte
 	}
 
+	var copyDone chan struct{}
+	var w *io.PipeWriter
 	if progress != nil {
 		var pw progressWriter
-		r, w := io.Pipe()
-		defer w.Close()
+		var r *io.PipeReader
+		r, w = io.Pipe()
 		mr := io.MultiWriter(&pw, w)
 		cmd.Stdout = mr
 		cmd.Stderr = mr
+		copyDone = make(chan struct{})
 		go func() {
+			defer close(copyDone)
 			if _, err := io.Copy(progress, r); err != nil {
 				log15.Error("error while copying progress", "error", err)
 			}
@@ -90,6 +109,15 @@ func runWithRemoteOpts(ctx context.Context, cmd *exec.Cmd, progress io.Writer) (
 	}
 
 	_, err := runCommand(ctx, cmd)
+	if w != nil {
+		// Wait until progress has seen all the output, so callers can rely
+		// on it being complete once we return.
+		w.Close()
+		<-copyDone
+	}
+	if err == nil && (subcommand == "clone" || subcommand == "fetch") {
+		recordTransferStats(subcommand, parseTransferStats(b.Bytes()))
+	}
 	return b.Bytes(), err
 }
 
@@ -100,6 +128,12 @@ func configureGitCommand(cmd *exec.Cmd) {
 
 	cmd.Env = append(cmd.Env, "GIT_ASKPASS=true") // disable password prompt
 
+	// Credentials are only ever passed via the remote URL, so git must never
+	// fall back to prompting on the terminal. This guarantees fetches of
+	// public repositories can't block on a prompt, regardless of the git
+	// config on the host.
+	cmd.Env = append(cmd.Env, "GIT_TERMINAL_PROMPT=0")
+
 	// Suppress asking to add SSH host key to known_hosts (which will hang because
 	// the command is non-interactive).
 	//
@@ -120,21 +154,159 @@ func configureGitCommand(cmd *exec.Cmd) {
 	cmd.Args = append(cmd.Args[:1], append(extraArgs, cmd.Args[1:]...)...)
 }
 
+// gitSubcommand returns the git subcommand of args, skipping over any "-c"
+// options preceding it. It returns the empty string if there is none.
+func gitSubcommand(args []string) string {
+	for i := 1; i < len(args); i++ {
+		if args[i] == "-c" {
+			i++
+			continue
+		}
+		return args[i]
+	}
+	return ""
+}
+
+var logPriorityCommandNotFoundOnce sync.Once
+
+// setBackgroundPriority wraps cmd with nice and ionice according to
+// s.GitNice and s.GitIONiceClass, so that background clones and fetches
+// yield CPU and disk IO to interactive requests. Child processes git spawns
+// (such as gc --auto) inherit the priority.
+//
+// It must be called after configureGitCommand since it replaces cmd.Path
+// and prefixes cmd.Args.
+func (s *Server) setBackgroundPriority(cmd *exec.Cmd) {
+	var prefix []string
+	if s.GitIONiceClass != 0 && runtime.GOOS == "linux" {
+		prefix = append(prefix, "ionice", "-c", strconv.Itoa(s.GitIONiceClass))
+	}
+	if s.GitNice != 0 {
+		prefix = append(prefix, "nice", "-n", strconv.Itoa(s.GitNice))
+	}
+	if len(prefix) == 0 {
+		return
+	}
+
+	// The git process does not inherit our PATH (see configureGitCommand), so
+	// we resolve the wrapper commands to absolute paths ourselves.
+	for i, arg := range prefix {
+		if arg != "ionice" && arg != "nice" {
+			continue
+		}
+		path, err := exec.LookPath(arg)
+		if err != nil {
+			logPriorityCommandNotFoundOnce.Do(func() {
+				log15.Warn("Unable to adjust priority of git commands.", "command", arg, "error", err)
+			})
+			return
+		}
+		prefix[i] = path
+	}
+
+	cmd.Args = append(append(prefix, cmd.Path), cmd.Args[1:]...)
+	cmd.Path = prefix[0]
+}
+
 // repoCloned checks if dir or `${dir}/.git` is a valid GIT_DIR.
 var repoCloned = func(dir GitDir) bool {
-	_, err := os.Stat(dir.Path("HEAD"))
+	_, err := reposFS.Stat(dir.Path("HEAD"))
 	return !os.IsNotExist(err)
 }
 
+// repoShallow reports whether dir is a shallow clone, i.e. has truncated
+// history.
+func repoShallow(dir GitDir) bool {
+	_, err := reposFS.Stat(dir.Path("shallow"))
+	return err == nil
+}
+
+// isEmptyRepo reports whether dir is a clone of an empty repository, i.e. it
+// has no refs and HEAD is unborn. Commands which resolve HEAD fail in empty
+// repositories. It only inspects the files of dir, since it runs on every
+// repo info request.
+func isEmptyRepo(dir GitDir) (bool, error) {
+	head, err := reposFS.ReadFile(dir.Path("HEAD"))
+	if err != nil {
+		return false, err
+	}
+	if git.IsAbsoluteRevision(string(bytes.TrimSpace(head))) {
+		// A detached HEAD always points to a commit.
+		return false, nil
+	}
+
+	// Without any refs the ref HEAD points to cannot exist either.
+	packedRefs, err := reposFS.ReadFile(dir.Path("packed-refs"))
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	for _, line := range bytes.Split(packedRefs, []byte("\n")) {
+		// Skip the header and the peeled values of annotated tags.
+		if len(line) > 0 && line[0] != '#' && line[0] != '^' {
+			return false, nil
+		}
+	}
+
+	found, err := hasLooseRef(dir.Path("refs"))
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	return !found, nil
+}
+
+// hasLooseRef reports whether the directory refsDir, e.g. refs/ of a
+// GIT_DIR, contains a loose ref.
+func hasLooseRef(refsDir string) (bool, error) {
+	fis, err := reposFS.ReadDir(refsDir)
+	if err != nil {
+		return false, err
+	}
+	for _, fi := range fis {
+		if fi.IsDir() {
+			if found, err := hasLooseRef(filepath.Join(refsDir, fi.Name())); err != nil || found {
+				return found, err
+			}
+		} else if fi.Mode().IsRegular() && !strings.HasSuffix(fi.Name(), ".lock") {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// repoCorruption returns a description of why dir appears corrupt, or "" if
+// it looks healthy or does not exist. It only inspects the layout of dir so
+// that it is cheap enough to run on every repo info request; it does not
+// verify objects like git fsck.
+func repoCorruption(dir GitDir) string {
+	if _, err := reposFS.Stat(string(dir)); err != nil {
+		return ""
+	}
+	head, err := reposFS.ReadFile(dir.Path("HEAD"))
+	if err != nil {
+		// The janitor removes repositories missing HEAD.
+		return "missing HEAD"
+	}
+	head = bytes.TrimSpace(head)
+	if !bytes.HasPrefix(head, []byte("ref: ")) && !git.IsAbsoluteRevision(string(head)) {
+		return "invalid HEAD"
+	}
+	for _, name := range []string{"objects", "refs"} {
+		if fi, err := reposFS.Stat(dir.Path(name)); err != nil || !fi.IsDir() {
+			return "missing " + name + " directory"
+		}
+	}
+	return ""
+}
+
 // repoLastFetched returns the mtime of the repo's FETCH_HEAD, which is the date of the last successful `git remote
 // update` or `git fetch` (even if nothing new was fetched). As a special case when the repo has been cloned but
 // none of those other two operations have been run (and so FETCH_HEAD does not exist), it will return the mtime of HEAD.
 //
 // This breaks on file systems that do not record mtime and if Git ever changes this undocumented behavior.
 var repoLastFetched = func(dir GitDir) (time.Time, error) {
-	fi, err := os.Stat(dir.Path("FETCH_HEAD"))
+	fi, err := reposFS.Stat(dir.Path("FETCH_HEAD"))
 	if os.IsNotExist(err) {
-		fi, err = os.Stat(dir.Path("HEAD"))
+		fi, err = reposFS.Stat(dir.Path("HEAD"))
 	}
 	if err != nil {
 		return time.Time{}, err
@@ -153,7 +325,7 @@ var repoLastFetched = func(dir GitDir) (time.Time, error) {
 // As a special case, tries both the directory given, and the .git subdirectory,
 // because we're a bit inconsistent about which name to use.
 var repoLastChanged = func(dir GitDir) (time.Time, error) {
-	fi, err := os.Stat(dir.Path("sg_refhash"))
+	fi, err := reposFS.Stat(dir.Path("sg_refhash"))
 	if os.IsNotExist(err) {
 		return repoLastFetched(dir)
 	}
@@ -210,6 +382,12 @@ func (c *writeCounter) Write(p []byte) (n int, err error) {
 // This lets, e.g., clients with a context deadline see as much partial response
 // body as possible.
 type flushingResponseWriter struct {
+	// busySince is the time in UnixNano at which the ongoing Write or Flush
+	// started, or 0. It is accessed atomically, since a Write blocked on a
+	// client which stopped reading holds mu.
+	busySince int64
+	stalled   int32 // accessed atomically
+
 	// mu ensures we don't concurrently call Flush and Write. It also protects
 	// state.
 	mu      sync.Mutex
@@ -217,15 +395,33 @@ type flushingResponseWriter struct {
 	flusher http.Flusher
 	closed  bool
 	doFlush bool
+
+	// flushFailed is set if the flush goroutine died. Writes still go to w,
+	// but are only flushed when the handler returns.
+	flushFailed bool
+
+	// idleTimeout is how long a Write or Flush may block before the client
+	// is considered stalled and onStall is called. Zero disables it.
+	idleTimeout time.Duration
+	onStall     func()
+	done        chan struct{} // closed by Close
 }
 
+// errClientStalled is returned by flushingResponseWriter.Write once the
+// client stopped reading the response.
+var errClientStalled = errors.New("client stopped reading the response")
+
 var logUnflushableResponseWriterOnce sync.Once
 
 // newFlushingResponseWriter creates a new flushing response writer. Callers
 // must call Close to free the resources created by the writer.
 //
+// If idleTimeout is non-zero and a write to the client makes no progress for
+// idleTimeout, onStall is called, e.g. to cancel the command producing the
+// response, and further writes fail.
+//
 // If w does not support flushing, it returns nil.
-func newFlushingResponseWriter(w http.ResponseWriter) *flushingResponseWriter {
+func newFlushingResponseWriter(w http.ResponseWriter, idleTimeout time.Duration, onStall func()) *flushingResponseWriter {
 	// We panic if we don't implement the needed interfaces.
 	flusher := hackilyGetHTTPFlusher(w)
 	if flusher == nil {
@@ -237,6 +433,12 @@ func newFlushingResponseWriter(w http.ResponseWriter) *flushingResponseWriter {
 
 	f := &flushingResponseWriter{w: w, flusher: flusher}
 	go f.periodicFlush()
+	if idleTimeout > 0 {
+		f.idleTimeout = idleTimeout
+		f.onStall = onStall
+		f.done = make(chan struct{})
+		go f.watchStalls()
+	}
 	return f
 }
 
@@ -274,9 +476,14 @@ func (f *flushingResponseWriter) WriteHeader(code int) { f.w.WriteHeader(code) }
 
 // Write implements http.ResponseWriter.
 func (f *flushingResponseWriter) Write(p []byte) (int, error) {
+	if atomic.LoadInt32(&f.stalled) != 0 {
+		return 0, errClientStalled
+	}
 	f.mu.Lock()
+	f.setBusy(true)
 	n, err := f.w.Write(p)
-	if n > 0 {
+	f.setBusy(false)
+	if n > 0 && !f.flushFailed {
 		f.doFlush = true
 	}
 	f.mu.Unlock()
@@ -284,27 +491,240 @@ func (f *flushingResponseWriter) Write(p []byte) (int, error) {
 }
 
 func (f *flushingResponseWriter) periodicFlush() {
+	defer func() {
+		if err := recover(); err != nil {
+			log15.Error("flushingResponseWriter: flush goroutine panicked, no longer flushing", "error", err, "stack", string(debug.Stack()))
+			f.mu.Lock()
+			f.flushFailed = true
+			f.doFlush = false
+			f.mu.Unlock()
+		}
+	}()
 	for {
 		time.Sleep(100 * time.Millisecond)
-		f.mu.Lock()
-		if f.closed {
-			f.mu.Unlock()
+		if !f.flush() {
 			break
 		}
-		if f.doFlush {
-			f.flusher.Flush()
+	}
+}
+
+// flush flushes pending writes. It returns false once the writer is closed
+// or the client stalled.
+func (f *flushingResponseWriter) flush() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed || atomic.LoadInt32(&f.stalled) != 0 {
+		return false
+	}
+	if f.doFlush {
+		f.setBusy(true)
+		defer f.setBusy(false)
+		f.flusher.Flush()
+	}
+	return true
+}
+
+// setBusy records the start or end of a Write or Flush.
+func (f *flushingResponseWriter) setBusy(busy bool) {
+	var since int64
+	if busy {
+		since = time.Now().UnixNano()
+	}
+	atomic.StoreInt64(&f.busySince, since)
+}
+
+// watchStalls calls onStall if a Write or Flush blocks for idleTimeout.
+func (f *flushingResponseWriter) watchStalls() {
+	interval := f.idleTimeout / 10
+	if interval < time.Millisecond {
+		interval = time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-f.done:
+			return
+		case now := <-ticker.C:
+			since := atomic.LoadInt64(&f.busySince)
+			if since == 0 || now.Sub(time.Unix(0, since)) < f.idleTimeout {
+				continue
+			}
+			atomic.StoreInt32(&f.stalled, 1)
+			log15.Warn("Client stopped reading the response.", "idleTimeout", f.idleTimeout)
+			if f.onStall != nil {
+				f.onStall()
+			}
+			return
 		}
-		f.mu.Unlock()
 	}
 }
 
 // Close signals to the flush goroutine to stop.
 func (f *flushingResponseWriter) Close() {
 	f.mu.Lock()
+	if !f.closed && f.done != nil {
+		close(f.done)
+	}
 	f.closed = true
 	f.mu.Unlock()
 }
 
+// connContextKey is the context key of the connection of a request, see
+// ConnContext.
+type connContextKey struct{}
+
+// ConnContext is meant to be used as http.Server.ConnContext. It makes the
+// connection of a request available to the handler, so that exec requests
+// can close it once the client stopped reading: a write blocked on such a
+// client only returns once the connection is closed.
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connContextKey{}, c)
+}
+
+// closeConn closes the connection of r, if ConnContext made it available.
+func closeConn(r *http.Request) {
+	if c, ok := r.Context().Value(connContextKey{}).(net.Conn); ok {
+		c.Close()
+	}
+}
+
+// acceptsGzip reports whether the client of r accepts gzip encoded
+// responses.
+func acceptsGzip(r *http.Request) bool {
+	for _, v := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(v, ";")
+		if strings.ToLower(strings.TrimSpace(parts[0])) != "gzip" {
+			continue
+		}
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if !strings.HasPrefix(param, "q=") {
+				continue
+			}
+			if q, err := strconv.ParseFloat(param[len("q="):], 64); err == nil && q == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// compressedPrefixes are the magic numbers of compressed formats. Responses
+// starting with one of them are not compressed again.
+var compressedPrefixes = [][]byte{
+	[]byte("PACK"),             // git pack file
+	[]byte("\x1f\x8b"),         // gzip
+	[]byte("PK\x03\x04"),       // zip
+	[]byte("BZh"),              // bzip2
+	[]byte("\xfd7zXZ\x00"),     // xz
+	[]byte("\x28\xb5\x2f\xfd"), // zstd
+}
+
+// gzipResponseWriter is a http.ResponseWriter which gzip compresses the
+// response body. The decision whether to compress is made on the first
+// Write, so that bodies which are already compressed are written unchanged.
+// Callers must call Close to finish the compressed stream.
+//
+// It implements http.Flusher by flushing the compressed stream, so it can be
+// wrapped by newFlushingResponseWriter.
+type gzipResponseWriter struct {
+	// mu protects all fields, since Flush is called concurrently by
+	// flushingResponseWriter.
+	mu      sync.Mutex
+	w       http.ResponseWriter
+	flusher http.Flusher // nil if w does not support flushing
+	code    int          // status code to write once we decided
+	decided bool         // whether we have written the header
+	gz      *gzip.Writer // nil if the body is written uncompressed
+}
+
+func newGzipResponseWriter(w http.ResponseWriter) *gzipResponseWriter {
+	return &gzipResponseWriter{w: w, flusher: hackilyGetHTTPFlusher(w)}
+}
+
+// Header implements http.ResponseWriter.
+func (g *gzipResponseWriter) Header() http.Header { return g.w.Header() }
+
+// WriteHeader implements http.ResponseWriter. The header is only written
+// once the first byte of the body is written or on Close.
+func (g *gzipResponseWriter) WriteHeader(code int) {
+	g.mu.Lock()
+	if !g.decided && g.code == 0 {
+		g.code = code
+	}
+	g.mu.Unlock()
+}
+
+// Write implements http.ResponseWriter.
+func (g *gzipResponseWriter) Write(p []byte) (int, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.decided {
+		g.decide(p)
+	}
+	if g.gz != nil {
+		return g.gz.Write(p)
+	}
+	return g.w.Write(p)
+}
+
+// decide writes the header, compressing the body unless it starts with p
+// and p is already compressed.
+func (g *gzipResponseWriter) decide(p []byte) {
+	g.decided = true
+	g.w.Header().Add("Vary", "Accept-Encoding")
+
+	compressed := false
+	for _, prefix := range compressedPrefixes {
+		if bytes.HasPrefix(p, prefix) {
+			compressed = true
+			break
+		}
+	}
+	if !compressed {
+		g.w.Header().Del("Content-Length")
+		g.w.Header().Set("Content-Encoding", "gzip")
+		g.gz = gzip.NewWriter(g.w)
+	}
+	if g.code != 0 {
+		g.w.WriteHeader(g.code)
+	}
+}
+
+// Flush implements http.Flusher.
+func (g *gzipResponseWriter) Flush() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.gz != nil {
+		if err := g.gz.Flush(); err != nil {
+			return
+		}
+	}
+	if g.decided && g.flusher != nil {
+		g.flusher.Flush()
+	}
+}
+
+// Close finishes the compressed stream. It writes the header if nothing was
+// written yet.
+func (g *gzipResponseWriter) Close() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.decided {
+		g.decided = true
+		if g.code != 0 {
+			g.w.WriteHeader(g.code)
+		}
+		return nil
+	}
+	if g.gz != nil {
+		return g.gz.Close()
+	}
+	return nil
+}
+
 // progressWriter is an io.Writer that writes to a buffer.
 // '\r' resets the write offset to the index after last '\n' in the buffer,
 // or the beginning of the buffer if a '\n' has not been written yet.
@@ -362,6 +782,56 @@ func (w *progressWriter) Bytes() []byte {
 	return w.buf
 }
 
+// logLineWriter is an io.Writer which logs every line written to it as a
+// separate log entry. Lines are logged once they are terminated by '\n', so
+// callers must call Close to log a final unterminated line.
+//
+// Only the text after the last '\r' of a line is logged, so progress updates
+// are reduced to their final state.
+type logLineWriter struct {
+	log      func(msg string, ctx ...interface{})
+	redactor *urlRedactor
+	buf      []byte
+}
+
+// newLogLineWriter returns a logLineWriter which logs via log with a "line"
+// context field. 🚨 SECURITY: Lines are redacted with redactor since git output
+// can contain the remote URL including credentials.
+func newLogLineWriter(log func(msg string, ctx ...interface{}), redactor *urlRedactor) *logLineWriter {
+	return &logLineWriter{log: log, redactor: redactor}
+}
+
+func (w *logLineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		idx := bytes.IndexByte(w.buf, '\n')
+		if idx == -1 {
+			break
+		}
+		w.logLine(w.buf[:idx])
+		w.buf = w.buf[idx+1:]
+	}
+	return len(p), nil
+}
+
+// Close logs any remaining unterminated line.
+func (w *logLineWriter) Close() error {
+	w.logLine(w.buf)
+	w.buf = nil
+	return nil
+}
+
+func (w *logLineWriter) logLine(line []byte) {
+	if idx := bytes.LastIndexByte(line, '\r'); idx >= 0 {
+		line = line[idx+1:]
+	}
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 {
+		return
+	}
+	w.log("git output", "line", w.redactor.redact(string(line)))
+}
+
 // mapToLog15Ctx translates a map to log15 context fields.
 func mapToLog15Ctx(m map[string]interface{}) []interface{} {
 	// sort so its stable
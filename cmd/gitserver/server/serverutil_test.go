@@ -1,20 +1,31 @@
 package server
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
 	"io/ioutil"
+	"net/http"
 	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"reflect"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestConfigureGitCommand(t *testing.T) {
 	expectedEnv := []string{
 		"GIT_ASKPASS=true",
+		"GIT_TERMINAL_PROMPT=0",
 		"GIT_SSH_COMMAND=ssh -o BatchMode=yes -o ConnectTimeout=30",
 	}
 	tests := []struct {
@@ -54,6 +65,105 @@ func TestConfigureGitCommand(t *testing.T) {
 	}
 }
 
+func TestGitSubcommand(t *testing.T) {
+	tests := map[string][]string{
+		"fetch": {"git", "-c", "pack.windowMemory=10m", "fetch", "--prune"},
+		"clone": {"git", "clone", "-c", "foo=bar"},
+		"":      {"git", "-c", "foo=bar"},
+	}
+	for want, args := range tests {
+		if got := gitSubcommand(args); got != want {
+			t.Errorf("gitSubcommand(%q) = %q, want %q", args, got, want)
+		}
+	}
+}
+
+func TestSetBackgroundPriority(t *testing.T) {
+	nice, err := exec.LookPath("nice")
+	if err != nil {
+		t.Skip("nice not found")
+	}
+
+	t.Run("unconfigured", func(t *testing.T) {
+		cmd := exec.Command("git", "fetch")
+		want := append([]string{}, cmd.Args...)
+		(&Server{}).setBackgroundPriority(cmd)
+		if !reflect.DeepEqual(cmd.Args, want) {
+			t.Errorf("\ngot:  %q\nwant: %q", cmd.Args, want)
+		}
+	})
+
+	t.Run("nice", func(t *testing.T) {
+		cmd := exec.Command("git", "fetch")
+		gitPath := cmd.Path
+		(&Server{GitNice: 10}).setBackgroundPriority(cmd)
+		want := []string{nice, "-n", "10", gitPath, "fetch"}
+		if !reflect.DeepEqual(cmd.Args, want) || cmd.Path != nice {
+			t.Errorf("\ngot:  %s %q\nwant: %s %q", cmd.Path, cmd.Args, nice, want)
+		}
+	})
+
+	t.Run("ionice", func(t *testing.T) {
+		if runtime.GOOS != "linux" {
+			t.Skip("ionice is only supported on linux")
+		}
+		ionice, err := exec.LookPath("ionice")
+		if err != nil {
+			t.Skip("ionice not found")
+		}
+		cmd := exec.Command("git", "fetch")
+		gitPath := cmd.Path
+		(&Server{GitNice: 5, GitIONiceClass: 3}).setBackgroundPriority(cmd)
+		want := []string{ionice, "-c", "3", nice, "-n", "5", gitPath, "fetch"}
+		if !reflect.DeepEqual(cmd.Args, want) || cmd.Path != ionice {
+			t.Errorf("\ngot:  %s %q\nwant: %s %q", cmd.Path, cmd.Args, ionice, want)
+		}
+	})
+
+	t.Run("spawned process", func(t *testing.T) {
+		if runtime.GOOS != "linux" {
+			t.Skip("reading niceness from /proc is only supported on linux")
+		}
+		dir, err := ioutil.TempDir("", "gitserver-priority")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		// Stand in for git with a script reporting its own niceness (field
+		// 19 of /proc/<pid>/stat).
+		script := filepath.Join(dir, "git")
+		writeFile(t, script, []byte("#!/bin/sh\nexec awk '{print $19}' /proc/self/stat\n"))
+		if err := os.Chmod(script, 0700); err != nil {
+			t.Fatal(err)
+		}
+
+		base, err := exec.Command("awk", "{print $19}", "/proc/self/stat").Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		baseNice, err := strconv.Atoi(strings.TrimSpace(string(base)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cmd := exec.Command("git", "fetch")
+		cmd.Path = script
+		(&Server{GitNice: 3}).setBackgroundPriority(cmd)
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := baseNice + 3
+		if want > 19 {
+			want = 19
+		}
+		if got := strings.TrimSpace(string(out)); got != strconv.Itoa(want) {
+			t.Errorf("got niceness %s, want %d", got, want)
+		}
+	})
+}
+
 func TestProgressWriter(t *testing.T) {
 	testCases := []struct {
 		name   string
@@ -169,6 +279,63 @@ func TestProgressWriter(t *testing.T) {
 	}
 }
 
+func TestLogLineWriter(t *testing.T) {
+	var got []string
+	log := func(msg string, ctx ...interface{}) {
+		if msg != "git output" || len(ctx) != 2 || ctx[0] != "line" {
+			t.Fatalf("unexpected log entry: %q %v", msg, ctx)
+		}
+		got = append(got, ctx[1].(string))
+	}
+	w := newLogLineWriter(log, newURLRedactor("https://token@example.com/foo/bar"))
+
+	writes := []string{
+		"From https://token@example.com/foo/bar\n",
+		" * [new branch]      master     -> master\n Receiving",
+		" objects:  50% (1/2)\rReceiving objects: 100% (2/2), done.\n\n",
+		"fatal: unterminated",
+	}
+	for _, s := range writes {
+		if _, err := w.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+
+	want := []string{
+		"From https://<redacted>@example.com/foo/bar",
+		"* [new branch]      master     -> master",
+		"Receiving objects: 100% (2/2), done.",
+		"fatal: unterminated",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("\ngot:  %q\nwant: %q", got, want)
+	}
+}
+
+func TestRunWithRemoteOpts_progress(t *testing.T) {
+	var lines []string
+	w := newLogLineWriter(func(msg string, ctx ...interface{}) {
+		lines = append(lines, ctx[1].(string))
+	}, newURLRedactor(""))
+
+	// git is required by configureGitCommand, but we only want to run a
+	// command producing known output.
+	cmd := exec.Command("git", "version")
+	output, err := (&Server{}).runWithRemoteOpts(context.Background(), cmd, w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	if len(lines) != 1 || !strings.HasPrefix(lines[0], "git version ") {
+		t.Errorf("unexpected log lines %q", lines)
+	}
+	if !strings.HasPrefix(string(output), "git version ") {
+		t.Errorf("unexpected output %q", output)
+	}
+}
+
 func TestUpdateFileIfDifferent(t *testing.T) {
 	dir, err := ioutil.TempDir("", t.Name())
 	if err != nil {
@@ -236,6 +403,37 @@ func TestUpdateFileIfDifferent(t *testing.T) {
 	}
 }
 
+func TestIsEmptyRepo(t *testing.T) {
+	remote, cleanup := tmpDir(t)
+	defer cleanup()
+	runCmd(t, remote, "git", "init", ".")
+
+	for _, layout := range []string{"bare", "work tree"} {
+		dir, cleanup := tmpDir(t)
+		defer cleanup()
+		gitDir := GitDir(filepath.Join(dir, ".git"))
+		if layout == "bare" {
+			runCmd(t, dir, "git", "clone", "--mirror", remote, ".git")
+		} else {
+			runCmd(t, dir, "git", "init", ".")
+		}
+		if empty, err := isEmptyRepo(gitDir); err != nil || !empty {
+			t.Errorf("%s: got empty=%v, err=%v for an empty repository", layout, empty, err)
+		}
+	}
+
+	// The refs of a mirror clone are packed, those of the remote loose.
+	runCmd(t, remote, "git", "commit", "--allow-empty", "-m", "init")
+	dir, cleanup2 := tmpDir(t)
+	defer cleanup2()
+	runCmd(t, dir, "git", "clone", "--mirror", remote, ".git")
+	for _, gitDir := range []GitDir{GitDir(filepath.Join(dir, ".git")), GitDir(filepath.Join(remote, ".git"))} {
+		if empty, err := isEmptyRepo(gitDir); err != nil || empty {
+			t.Errorf("%s: got empty=%v, err=%v for a repository with commits", gitDir, empty, err)
+		}
+	}
+}
+
 func TestFlushingResponseWriter(t *testing.T) {
 	flush := make(chan struct{})
 	fw := &flushingResponseWriter{
@@ -268,8 +466,266 @@ func TestFlushingResponseWriter(t *testing.T) {
 	}
 }
 
+func TestFlushingResponseWriter_flushPanic(t *testing.T) {
+	rec := httptest.NewRecorder()
+	fw := &flushingResponseWriter{
+		w: rec,
+		flusher: flushFunc(func() {
+			panic("flush failed")
+		}),
+	}
+	done := make(chan struct{})
+	go func() {
+		fw.periodicFlush()
+		close(done)
+	}()
+
+	if _, err := fw.Write([]byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("periodic flush goroutine did not stop after panicking")
+	}
+
+	// Writes still work, without attempting to flush.
+	if _, err := fw.Write([]byte(" there")); err != nil {
+		t.Fatal(err)
+	}
+	fw.mu.Lock()
+	flushFailed, doFlush := fw.flushFailed, fw.doFlush
+	fw.mu.Unlock()
+	if !flushFailed || doFlush {
+		t.Errorf("got flushFailed=%v doFlush=%v, want writer marked as not flushing", flushFailed, doFlush)
+	}
+	if got := rec.Body.String(); got != "hi there" {
+		t.Errorf("got body %q, want %q", got, "hi there")
+	}
+	if since := atomic.LoadInt64(&fw.busySince); since != 0 {
+		t.Error("writer is still busy after the flush panicked")
+	}
+	fw.Close()
+}
+
+func TestFlushingResponseWriter_idleTimeout(t *testing.T) {
+	const idleTimeout = 50 * time.Millisecond
+	stalled := make(chan struct{})
+	unblock := make(chan struct{})
+	w := &blockingResponseWriter{ResponseRecorder: httptest.NewRecorder(), unblock: unblock}
+	fw := newFlushingResponseWriter(w, idleTimeout, func() { close(stalled) })
+	defer fw.Close()
+
+	// Writes which make progress don't stall, even if they take a while in
+	// total.
+	for i := 0; i < 5; i++ {
+		if _, err := fw.Write([]byte("hi")); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(idleTimeout / 2)
+	}
+	select {
+	case <-stalled:
+		t.Fatal("writes making progress were considered stalled")
+	default:
+	}
+
+	// The client stops reading.
+	w.block()
+	start := time.Now()
+	writeDone := make(chan error, 1)
+	go func() {
+		_, err := fw.Write([]byte("blocked"))
+		writeDone <- err
+	}()
+	select {
+	case <-stalled:
+		if elapsed := time.Since(start); elapsed < idleTimeout {
+			t.Errorf("stalled after %s, before the idle timeout of %s", elapsed, idleTimeout)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stalled write was not detected")
+	}
+
+	close(unblock)
+	<-writeDone
+	if _, err := fw.Write([]byte("more")); err != errClientStalled {
+		t.Errorf("got error %v writing after stalling, want %v", err, errClientStalled)
+	}
+}
+
+// blockingResponseWriter is a ResponseWriter whose writes block until unblock
+// is closed once block was called, like the writes to a client which stopped
+// reading.
+type blockingResponseWriter struct {
+	*httptest.ResponseRecorder
+	unblock chan struct{}
+	blocked int32
+}
+
+func (w *blockingResponseWriter) block() { atomic.StoreInt32(&w.blocked, 1) }
+
+func (w *blockingResponseWriter) Write(p []byte) (int, error) {
+	if atomic.LoadInt32(&w.blocked) != 0 {
+		<-w.unblock
+	}
+	return w.ResponseRecorder.Write(p)
+}
+
 type flushFunc func()
 
 func (f flushFunc) Flush() {
 	f()
 }
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := map[string]bool{
+		"":                     false,
+		"gzip":                 true,
+		"deflate, gzip;q=1.0":  true,
+		"GZIP":                 true,
+		"br":                   false,
+		"gzip;q=0":             false,
+		"gzip; q=0.000":        false,
+		"identity, gzip;q=0.5": true,
+	}
+	for header, want := range tests {
+		r := httptest.NewRequest("POST", "/exec", nil)
+		if header != "" {
+			r.Header.Set("Accept-Encoding", header)
+		}
+		if got := acceptsGzip(r); got != want {
+			t.Errorf("acceptsGzip(%q) = %v, want %v", header, got, want)
+		}
+	}
+}
+
+func TestGzipResponseWriter(t *testing.T) {
+	t.Run("compresses", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		gw := newGzipResponseWriter(rec)
+		gw.WriteHeader(http.StatusOK)
+		if _, err := gw.Write([]byte("hello ")); err != nil {
+			t.Fatal(err)
+		}
+
+		// Flushing must make the data written so far readable by the client.
+		gw.Flush()
+		if !rec.Flushed {
+			t.Error("expected flush of underlying writer")
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(rec.Body.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, len("hello "))
+		if _, err := io.ReadFull(zr, buf); err != nil || string(buf) != "hello " {
+			t.Fatalf("got %q %v after flush, want %q", buf, err, "hello ")
+		}
+
+		if _, err := gw.Write([]byte("world")); err != nil {
+			t.Fatal(err)
+		}
+		if err := gw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if got := rec.Header().Get("Content-Encoding"); got != "gzip" {
+			t.Errorf("got Content-Encoding %q, want gzip", got)
+		}
+		zr, err = gzip.NewReader(bytes.NewReader(rec.Body.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(zr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != "hello world" {
+			t.Errorf("got body %q, want %q", body, "hello world")
+		}
+	})
+
+	t.Run("already compressed", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		gw := newGzipResponseWriter(rec)
+		gw.WriteHeader(http.StatusOK)
+		pack := "PACK\x00\x00\x00\x02"
+		if _, err := gw.Write([]byte(pack)); err != nil {
+			t.Fatal(err)
+		}
+		if err := gw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if got := rec.Header().Get("Content-Encoding"); got != "" {
+			t.Errorf("got Content-Encoding %q, want none", got)
+		}
+		if got := rec.Body.String(); got != pack {
+			t.Errorf("got body %q, want %q", got, pack)
+		}
+	})
+
+	t.Run("no body", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		gw := newGzipResponseWriter(rec)
+		gw.WriteHeader(http.StatusNotModified)
+		if err := gw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 || rec.Header().Get("Content-Encoding") != "" {
+			t.Errorf("got %d %q %v, want empty 304", rec.Code, rec.Body.String(), rec.Header())
+		}
+	})
+}
+
+func TestRunWithRemoteOpts_gitOperationsRunning(t *testing.T) {
+	running := func() float64 {
+		return testutil.ToFloat64(gitOperationsRunning.WithLabelValues("fetch"))
+	}
+	defer func() { runCommandMock = nil }()
+	s := &Server{}
+	fetch := func(ctx context.Context) {
+		t.Helper()
+		cmd := exec.CommandContext(ctx, "git", "fetch", "https://example.com/foo/bar")
+		_, _ = s.runWithRemoteOpts(ctx, cmd, nil)
+	}
+
+	runCommandMock = func(ctx context.Context, cmd *exec.Cmd) (int, error) {
+		if got := running(); got != 1 {
+			t.Errorf("got %v running fetches during a fetch, want 1", got)
+		}
+		return 0, nil
+	}
+	fetch(context.Background())
+	if got := running(); got != 0 {
+		t.Errorf("got %v running fetches after a fetch, want 0", got)
+	}
+
+	// Cancelled fetches are no longer counted.
+	runCommandMock = func(ctx context.Context, cmd *exec.Cmd) (int, error) {
+		<-ctx.Done()
+		return -1, ctx.Err()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fetch(ctx)
+	}()
+	cancel()
+	<-done
+	if got := running(); got != 0 {
+		t.Errorf("got %v running fetches after a cancelled fetch, want 0", got)
+	}
+
+	// Neither are fetches which panic.
+	runCommandMock = func(ctx context.Context, cmd *exec.Cmd) (int, error) {
+		panic("fetch panicked")
+	}
+	func() {
+		defer func() { _ = recover() }()
+		fetch(context.Background())
+	}()
+	if got := running(); got != 0 {
+		t.Errorf("got %v running fetches after a fetch panicked, want 0", got)
+	}
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sourcegraph/sourcegraph/internal/mutablelimiter"
+)
+
+// ValidateStorageCloneLimits returns an error if limits is not valid for
+// Server.StorageCloneLimits.
+func ValidateStorageCloneLimits(limits map[string]int) error {
+	for dir, limit := range limits {
+		if dir == "" || filepath.IsAbs(dir) || filepath.Clean(dir) != dir || strings.HasPrefix(dir, "..") || strings.HasPrefix(filepath.Base(dir), tempDirName) {
+			return errors.Errorf("invalid storage directory %q, want a clean path relative to the repos dir", dir)
+		}
+		if limit < 1 {
+			return errors.Errorf("invalid clone limit %d for %s, want at least 1", limit, dir)
+		}
+	}
+	return nil
+}
+
+// storageDir returns the directory of s.StorageCloneLimits containing dir.
+// If several contain it, the innermost wins. ok is false if dir is stored
+// on the device of ReposDir.
+func (s *Server) storageDir(dir GitDir) (storageDir string, ok bool) {
+	for d := range s.StorageCloneLimits {
+		abs := filepath.Join(s.ReposDir, d)
+		if strings.HasPrefix(string(dir), abs+string(filepath.Separator)) && len(abs) > len(storageDir) {
+			storageDir, ok = abs, true
+		}
+	}
+	return storageDir, ok
+}
+
+// cloneLimiterFor returns the limiter for clones and fetches of dir, which
+// is shared by all repositories on its storage device.
+func (s *Server) cloneLimiterFor(dir GitDir) *mutablelimiter.Limiter {
+	storageDir, ok := s.storageDir(dir)
+	if !ok {
+		return s.cloneLimiter
+	}
+	s.storageLimitersMu.Lock()
+	defer s.storageLimitersMu.Unlock()
+	l, ok := s.storageLimiters[storageDir]
+	if !ok {
+		if s.storageLimiters == nil {
+			s.storageLimiters = make(map[string]*mutablelimiter.Limiter)
+		}
+		// The number of limiters is bounded by s.StorageCloneLimits.
+		l = mutablelimiter.New(s.StorageCloneLimits[strings.TrimPrefix(storageDir, s.ReposDir+string(filepath.Separator))])
+		s.storageLimiters[storageDir] = l
+	}
+	return l
+}
+
+// tempDirFor is like tempDir, but the temporary directory is on the storage
+// device of dir, so it can be renamed to dir.
+func (s *Server) tempDirFor(dir GitDir, prefix string) (string, error) {
+	storageDir, ok := s.storageDir(dir)
+	if !ok {
+		return s.tempDir(prefix)
+	}
+	tmp := filepath.Join(storageDir, tempDirName)
+	if err := os.MkdirAll(tmp, os.ModePerm); err != nil {
+		return "", err
+	}
+	return ioutil.TempDir(tmp, prefix)
+}
+
+// isStorageTempDir reports whether path is the temporary directory of one of
+// s.StorageCloneLimits in root, or a directory being removed by clearTmp.
+func (s *Server) isStorageTempDir(root, path string) bool {
+	if !strings.HasPrefix(filepath.Base(path), tempDirName) {
+		return false
+	}
+	parent := filepath.Dir(path)
+	for d := range s.StorageCloneLimits {
+		if parent == filepath.Join(root, d) {
+			return true
+		}
+	}
+	return false
+}
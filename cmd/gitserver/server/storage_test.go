@@ -0,0 +1,130 @@
+package server
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sourcegraph/sourcegraph/internal/api"
+	"github.com/sourcegraph/sourcegraph/internal/mutablelimiter"
+)
+
+func TestServer_cloneLimiterFor(t *testing.T) {
+	reposDir, cleanup := tmpDir(t)
+	defer cleanup()
+	s := &Server{
+		ReposDir:     reposDir,
+		cloneLimiter: mutablelimiter.New(1),
+		StorageCloneLimits: map[string]int{
+			"github.com":             2,
+			"github.com/sourcegraph": 1,
+		},
+	}
+
+	// acquire reports whether a clone of repo can start while the clones
+	// acquired before are still running.
+	var cancels []context.CancelFunc
+	defer func() {
+		for _, cancel := range cancels {
+			cancel()
+		}
+	}()
+	acquire := func(repo string) bool {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, release, err := s.acquireCloneLimiter(ctx, s.dir(api.RepoName(repo)))
+		if err != nil {
+			return false
+		}
+		cancels = append(cancels, release)
+		return true
+	}
+
+	// Clones on the same device are capped at its limit, while the other
+	// devices are unaffected.
+	for _, repo := range []string{"github.com/foo/a", "github.com/bar/b"} {
+		if !acquire(repo) {
+			t.Fatalf("failed to acquire clone of %s within the device limit", repo)
+		}
+	}
+	if acquire("github.com/foo/c") {
+		t.Error("acquired clone beyond the device limit")
+	}
+	if !acquire("github.com/sourcegraph/sourcegraph") {
+		t.Error("failed to acquire clone on the innermost device")
+	}
+	if acquire("github.com/sourcegraph/other") {
+		t.Error("acquired clone beyond the innermost device limit")
+	}
+	if !acquire("gitlab.com/foo/a") {
+		t.Error("failed to acquire clone on the ReposDir device")
+	}
+	if acquire("gitlab.com/foo/b") {
+		t.Error("acquired clone beyond the ReposDir device limit")
+	}
+}
+
+func TestServer_tempDirFor(t *testing.T) {
+	reposDir, cleanup := tmpDir(t)
+	defer cleanup()
+	s := &Server{ReposDir: reposDir, StorageCloneLimits: map[string]int{"github.com": 1}}
+
+	tmp, err := s.tempDirFor(s.dir("github.com/foo/bar"), "clone-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(reposDir, "github.com", tempDirName) + string(filepath.Separator); !strings.HasPrefix(tmp, want) {
+		t.Errorf("got temporary directory %s, want it in %s", tmp, want)
+	}
+	if !s.ignorePath(filepath.Dir(tmp)) {
+		t.Error("temporary directory of storage device is not ignored")
+	}
+	if s.ignorePath(filepath.Join(reposDir, "github.com", "foo")) {
+		t.Error("repository directory of storage device is ignored")
+	}
+
+	tmp, err = s.tempDirFor(s.dir("gitlab.com/foo/bar"), "clone-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(reposDir, tempDirName) + string(filepath.Separator); !strings.HasPrefix(tmp, want) {
+		t.Errorf("got temporary directory %s, want it in %s", tmp, want)
+	}
+
+	// Temporary directories of storage devices are cleared on startup.
+	if _, err := s.SetupAndClearTmp(); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := filepath.Glob(filepath.Join(reposDir, "github.com", tempDirName, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("got %v after clearing temporary directories, want none", entries)
+	}
+	if _, err := os.Stat(filepath.Join(reposDir, "github.com")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidateStorageCloneLimits(t *testing.T) {
+	if err := ValidateStorageCloneLimits(map[string]int{"github.com": 1, "github.com/foo": 10}); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	for _, limits := range []map[string]int{
+		{"": 1},
+		{"/data/repos/github.com": 1},
+		{"../github.com": 1},
+		{"github.com/": 1},
+		{".tmp": 1},
+		{"github.com": 0},
+	} {
+		if err := ValidateStorageCloneLimits(limits); err == nil {
+			t.Errorf("expected error for %v", limits)
+		}
+	}
+}
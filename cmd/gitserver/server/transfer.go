@@ -0,0 +1,86 @@
+package server
+
+import (
+	"bytes"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sourcegraph/sourcegraph/internal/lazyregexp"
+)
+
+// transferStats is the amount of data a clone or fetch received.
+type transferStats struct {
+	Objects int64
+	Bytes   int64
+}
+
+var (
+	// receivingObjectsPattern matches the progress of git receiving a pack,
+	// e.g. "Receiving objects: 100% (1234/1234), 5.67 MiB | 1.20 MiB/s, done."
+	receivingObjectsPattern = lazyregexp.New(`Receiving objects: +\d+% \((\d+)/\d+\)(?:, ([\d.]+) (bytes?|KiB|MiB|GiB))?`)
+
+	// totalObjectsPattern matches the summary of the remote sending a pack,
+	// e.g. "remote: Total 1234 (delta 12), reused 0 (delta 0)".
+	totalObjectsPattern = lazyregexp.New(`Total (\d+) \(delta \d+\)`)
+
+	byteUnits = map[string]float64{
+		"byte":  1,
+		"bytes": 1,
+		"KiB":   1 << 10,
+		"MiB":   1 << 20,
+		"GiB":   1 << 30,
+	}
+)
+
+// parseTransferStats parses the progress output of git clone or fetch. The
+// last progress report wins, since progress lines are overwritten using
+// '\r'. Counts which are not part of output are zero, e.g. if git fetched
+// nothing or was not asked to report progress.
+func parseTransferStats(output []byte) transferStats {
+	var stats transferStats
+	lines := bytes.FieldsFunc(output, func(r rune) bool { return r == '\r' || r == '\n' })
+	for _, line := range lines {
+		if m := receivingObjectsPattern.FindSubmatch(line); m != nil {
+			stats.Objects, _ = strconv.ParseInt(string(m[1]), 10, 64)
+			stats.Bytes = 0
+			if len(m[2]) > 0 {
+				size, _ := strconv.ParseFloat(string(m[2]), 64)
+				stats.Bytes = int64(size * byteUnits[string(m[3])])
+			}
+		} else if m := totalObjectsPattern.FindSubmatch(line); m != nil && stats.Objects == 0 {
+			// Only used if git didn't report receiving objects, e.g. because
+			// the pack was too small.
+			stats.Objects, _ = strconv.ParseInt(string(m[1]), 10, 64)
+		}
+	}
+	return stats
+}
+
+// recordTransferStats records the data received by a successful clone or
+// fetch in the metrics for subcommand.
+func recordTransferStats(subcommand string, stats transferStats) {
+	transferObjects.WithLabelValues(subcommand).Observe(float64(stats.Objects))
+	transferBytes.WithLabelValues(subcommand).Observe(float64(stats.Bytes))
+}
+
+var (
+	transferObjects = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "src",
+		Subsystem: "gitserver",
+		Name:      "transfer_objects",
+		Help:      "Number of objects received by a clone or fetch.",
+		Buckets:   prometheus.ExponentialBuckets(1, 10, 8),
+	}, []string{"cmd"})
+	transferBytes = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "src",
+		Subsystem: "gitserver",
+		Name:      "transfer_bytes",
+		Help:      "Number of bytes received by a clone or fetch.",
+		Buckets:   prometheus.ExponentialBuckets(1024, 8, 9),
+	}, []string{"cmd"})
+)
+
+func init() {
+	prometheus.MustRegister(transferObjects)
+	prometheus.MustRegister(transferBytes)
+}
@@ -0,0 +1,48 @@
+package server
+
+import "testing"
+
+func TestParseTransferStats(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   transferStats
+	}{{
+		name: "fetch",
+		output: "remote: Enumerating objects: 1532, done.\n" +
+			"remote: Counting objects:  50% (766/1532)\rremote: Counting objects: 100% (1532/1532), done.\n" +
+			"remote: Total 1532 (delta 870), reused 1401 (delta 790), pack-reused 0\n" +
+			"Receiving objects:  12% (184/1532), 1.01 MiB | 1.00 MiB/s\r" +
+			"Receiving objects: 100% (1532/1532), 5.67 MiB | 2.10 MiB/s, done.\n" +
+			"Resolving deltas: 100% (870/870), done.\n" +
+			"From https://github.com/foo/bar\n" +
+			"   1234567..89abcde  master     -> master\n",
+		want: transferStats{Objects: 1532, Bytes: 5945425},
+	}, {
+		name: "small pack",
+		output: "remote: Total 3 (delta 0), reused 0 (delta 0)\n" +
+			"Receiving objects: 100% (3/3), 250 bytes | 250.00 KiB/s, done.\n",
+		want: transferStats{Objects: 3, Bytes: 250},
+	}, {
+		name:   "no size reported",
+		output: "remote: Total 2 (delta 0), reused 0 (delta 0)\nReceiving objects: 100% (2/2), done.\n",
+		want:   transferStats{Objects: 2},
+	}, {
+		name:   "only remote summary",
+		output: "remote: Total 7 (delta 1), reused 7 (delta 1)\n",
+		want:   transferStats{Objects: 7},
+	}, {
+		name:   "up to date",
+		output: "",
+	}, {
+		name:   "no progress output",
+		output: "From https://github.com/foo/bar\n * [new branch]      foo        -> foo\n",
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := parseTransferStats([]byte(test.output)); got != test.want {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/sourcegraph/sourcegraph/internal/api"
+)
+
+// workTree returns the directory holding the work tree of dir if
+// s.CloneWorkTree is set. The work tree is the parent of the GIT_DIR, i.e.
+// ${s.ReposDir}/${name}.
+func (s *Server) workTree(dir GitDir) (string, bool) {
+	if !s.CloneWorkTree {
+		return "", false
+	}
+	return filepath.Dir(string(dir)), true
+}
+
+// updateWorkTree checks out HEAD of dir into its work tree, if work trees are
+// enabled. It is called after every clone and fetch.
+//
+// The repository itself stays bare, so fetches can update the checked out
+// branch. The work tree is only passed explicitly to the commands updating
+// it.
+//
+// If RepoOptions.SparseCheckout is set for repo, only the paths matching its
+// patterns are checked out. Changed patterns apply on the next update.
+func (s *Server) updateWorkTree(ctx context.Context, repo api.RepoName, dir GitDir) error {
+	workTree, ok := s.workTree(dir)
+	if !ok {
+		return nil
+	}
+
+	// Empty repositories have nothing to check out.
+	cmd := exec.CommandContext(ctx, "git", "rev-parse", "--verify", "--quiet", "HEAD")
+	cmd.Dir = string(dir)
+	if err := cmd.Run(); err != nil {
+		return nil
+	}
+
+	patterns := s.repoOptions(repo).SparseCheckout
+	sparseFile := dir.Path("info", "sparse-checkout")
+	_, err := os.Stat(sparseFile)
+	wasSparse := err == nil
+	if len(patterns) == 0 && wasSparse {
+		// Check out all paths once to clear the skip-worktree bits of the
+		// index. Afterwards the work tree is updated as usual.
+		patterns = []string{"/*"}
+	}
+	var config []string
+	if len(patterns) > 0 {
+		if err := os.MkdirAll(filepath.Dir(sparseFile), os.ModePerm); err != nil {
+			return err
+		}
+		if _, err := updateFileIfDifferent(sparseFile, []byte(strings.Join(patterns, "\n")+"\n")); err != nil {
+			return err
+		}
+		config = []string{"-c", "core.sparseCheckout=true"}
+	}
+
+	for _, args := range [][]string{
+		{"--work-tree=" + workTree, "reset", "--hard", "--quiet"},
+		// Remove files deleted upstream. Nested repositories are kept, since
+		// git clean only removes them if -f is given twice.
+		{"--work-tree=" + workTree, "clean", "-fdq"},
+	} {
+		cmd := exec.CommandContext(ctx, "git", append(config, args...)...)
+		cmd.Dir = string(dir)
+		if _, err := cmd.Output(); err != nil {
+			return wrapCmdError(cmd, err)
+		}
+	}
+
+	if len(s.repoOptions(repo).SparseCheckout) == 0 && wasSparse {
+		return os.Remove(sparseFile)
+	}
+	return nil
+}
+
+// walkWorkTree calls fn for every file in workTree. It skips the GIT_DIR as
+// well as the directories of nested repositories.
+func walkWorkTree(workTree string, fn func(path string, fi os.FileInfo) error) error {
+	return filepath.Walk(workTree, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if !fi.IsDir() {
+			return fn(path, fi)
+		}
+		if path == workTree {
+			return nil
+		}
+		if fi.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if _, err := os.Stat(filepath.Join(path, ".git")); err == nil {
+			// The directory of another repository, e.g. of gitlab.com/foo/bar
+			// when walking gitlab.com/foo.
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
+
+// repoSize returns the size in bytes of the repository at dir, including its
+// work tree.
+func (s *Server) repoSize(dir GitDir) (int64, error) {
+	size, err := dirSize(string(dir))
+	if err != nil {
+		return 0, err
+	}
+	if workTree, ok := s.workTree(dir); ok {
+		err := walkWorkTree(workTree, func(_ string, fi os.FileInfo) error {
+			size += fi.Size()
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return size, nil
+}
+
+// removeWorkTree removes the files of workTree and the directories which
+// become empty. Files of nested repositories are kept.
+func removeWorkTree(workTree string) error {
+	dirs := map[string]bool{}
+	err := walkWorkTree(workTree, func(path string, _ os.FileInfo) error {
+		for d := filepath.Dir(path); d != workTree; d = filepath.Dir(d) {
+			dirs[d] = true
+		}
+		return os.Remove(path)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Remove the deepest directories first. Removing fails for directories
+	// which are not empty, e.g. because they contain a nested repository.
+	sorted := make([]string, 0, len(dirs))
+	for d := range dirs {
+		sorted = append(sorted, d)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return len(sorted[i]) > len(sorted[j]) })
+	for _, d := range sorted {
+		_ = os.Remove(d)
+	}
+	return nil
+}
@@ -0,0 +1,226 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/sourcegraph/sourcegraph/internal/api"
+	"github.com/sourcegraph/sourcegraph/internal/mutablelimiter"
+)
+
+func TestCloneWorkTree(t *testing.T) {
+	remote, cleanup1 := tmpDir(t)
+	defer cleanup1()
+
+	runCmd(t, remote, "git", "init", ".")
+	runCmd(t, remote, "sh", "-c", "echo hello > hello.txt && mkdir sub && echo bye > sub/bye.txt")
+	runCmd(t, remote, "git", "add", ".")
+	runCmd(t, remote, "git", "commit", "-m", "hello")
+
+	for _, workTree := range []bool{false, true} {
+		reposDir, err := ioutil.TempDir("", "gitserver-worktree")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(reposDir)
+
+		s := &Server{
+			ReposDir:         reposDir,
+			ctx:              context.Background(),
+			locker:           &RepositoryLocker{},
+			cloneLimiter:     mutablelimiter.New(1),
+			cloneableLimiter: mutablelimiter.New(1),
+			repoUpdateLocks:  make(map[api.RepoName]*locks),
+			CloneWorkTree:    workTree,
+		}
+		repo := api.RepoName("example.com/foo/bar")
+		if _, err := s.cloneRepo(context.Background(), repo, remote, &cloneOptions{Block: true}); err != nil {
+			t.Fatal(err)
+		}
+		dir := s.dir(repo)
+		root := filepath.Dir(string(dir))
+
+		if !repoCloned(dir) {
+			t.Fatalf("workTree=%v: expected repo to be cloned", workTree)
+		}
+		if _, err := repoLastFetched(dir); err != nil {
+			t.Fatalf("workTree=%v: %s", workTree, err)
+		}
+		bareSize, err := dirSize(string(dir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		size, err := s.repoSize(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !workTree {
+			assertFiles(t, root)
+			if size != bareSize {
+				t.Errorf("got size %d for bare clone, want %d", size, bareSize)
+			}
+			continue
+		}
+
+		assertFiles(t, root, "hello.txt", "sub/bye.txt")
+		if want := bareSize + int64(len("hello\nbye\n")); size != want {
+			t.Errorf("got size %d for work tree clone, want %d", size, want)
+		}
+
+		// Fetches update the work tree.
+		runCmd(t, remote, "sh", "-c", "git rm -q sub/bye.txt && echo new > new.txt && git add new.txt")
+		runCmd(t, remote, "git", "commit", "-m", "update")
+		if err := s.doRepoUpdate(context.Background(), repo, remote); err != nil {
+			t.Fatal(err)
+		}
+		assertFiles(t, root, "hello.txt", "new.txt")
+
+		// Removing the repository removes its work tree, but not nested
+		// repositories.
+		nested := s.dir("example.com/foo/bar/nested")
+		if err := os.MkdirAll(string(nested), 0700); err != nil {
+			t.Fatal(err)
+		}
+		writeFile(t, nested.Path("HEAD"), []byte("ref: refs/heads/master\n"))
+		if err := s.removeRepoDirectory(dir); err != nil {
+			t.Fatal(err)
+		}
+		assertPaths(t, root, "nested/.git/HEAD")
+	}
+}
+
+func TestCloneWorkTree_sparseCheckout(t *testing.T) {
+	remote, cleanup1 := tmpDir(t)
+	defer cleanup1()
+	reposDir, cleanup2 := tmpDir(t)
+	defer cleanup2()
+
+	runCmd(t, remote, "git", "init", ".")
+	runCmd(t, remote, "sh", "-c", "mkdir -p docs src/lib && echo a > README && echo b > docs/index.md && echo c > src/main.go && echo d > src/lib/lib.go")
+	runCmd(t, remote, "git", "add", ".")
+	runCmd(t, remote, "git", "commit", "-m", "init")
+
+	repo := api.RepoName("example.com/foo/bar")
+	s := &Server{
+		ReposDir:         reposDir,
+		ctx:              context.Background(),
+		locker:           &RepositoryLocker{},
+		cloneLimiter:     mutablelimiter.New(1),
+		cloneableLimiter: mutablelimiter.New(1),
+		repoUpdateLocks:  make(map[api.RepoName]*locks),
+		CloneWorkTree:    true,
+		RepoOptions: map[api.RepoName]RepoOptions{
+			repo: {SparseCheckout: []string{"/docs/"}},
+		},
+	}
+	if _, err := s.cloneRepo(context.Background(), repo, remote, &cloneOptions{Block: true}); err != nil {
+		t.Fatal(err)
+	}
+	root := filepath.Dir(string(s.dir(repo)))
+	assertFiles(t, root, "docs/index.md")
+
+	// Changed patterns apply on the next update, without recloning.
+	s.RepoOptions[repo] = RepoOptions{SparseCheckout: []string{"/src/", "!/src/lib/"}}
+	if err := s.doRepoUpdate(context.Background(), repo, remote); err != nil {
+		t.Fatal(err)
+	}
+	assertFiles(t, root, "src/main.go")
+
+	// Without patterns all paths are checked out again.
+	delete(s.RepoOptions, repo)
+	if err := s.doRepoUpdate(context.Background(), repo, remote); err != nil {
+		t.Fatal(err)
+	}
+	assertFiles(t, root, "README", "docs/index.md", "src/lib/lib.go", "src/main.go")
+	if _, err := os.Stat(s.dir(repo).Path("info", "sparse-checkout")); !os.IsNotExist(err) {
+		t.Errorf("expected sparse-checkout file to be removed, got %v", err)
+	}
+}
+
+// assertFiles checks that the files below root, excluding those in .git
+// directories, are want.
+func assertFiles(t *testing.T, root string, want ...string) {
+	t.Helper()
+	var got []string
+	err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() && fi.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if !fi.IsDir() {
+			rel, _ := filepath.Rel(root, path)
+			got = append(got, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) && len(got)+len(want) > 0 {
+		t.Errorf("got files %q, want %q", got, want)
+	}
+}
+
+func TestCloneWorkTree_walkGitDirs(t *testing.T) {
+	remote, cleanup1 := tmpDir(t)
+	defer cleanup1()
+
+	// Files named like the contents of a GIT_DIR must not make directories
+	// of the work tree look like repositories.
+	runCmd(t, remote, "git", "init", ".")
+	runCmd(t, remote, "sh", "-c", "echo hello > HEAD && mkdir sub && echo bye > sub/HEAD")
+	runCmd(t, remote, "git", "add", ".")
+	runCmd(t, remote, "git", "commit", "-m", "hello")
+
+	reposDir, err := ioutil.TempDir("", "gitserver-worktree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(reposDir)
+
+	s := &Server{
+		ReposDir:         reposDir,
+		ctx:              context.Background(),
+		locker:           &RepositoryLocker{},
+		cloneLimiter:     mutablelimiter.New(1),
+		cloneableLimiter: mutablelimiter.New(1),
+		repoUpdateLocks:  make(map[api.RepoName]*locks),
+		CloneWorkTree:    true,
+	}
+	for _, repo := range []api.RepoName{"example.com/foo/bar", "example.com/foo/bar/sub/nested"} {
+		if _, err := s.cloneRepo(context.Background(), repo, remote, &cloneOptions{Block: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	gitDirs, err := s.findGitDirs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(gitDirs, func(i, j int) bool { return gitDirs[i] < gitDirs[j] })
+	want := []GitDir{s.dir("example.com/foo/bar"), s.dir("example.com/foo/bar/sub/nested")}
+	if !reflect.DeepEqual(gitDirs, want) {
+		t.Errorf("got GIT_DIRs %v, want %v", gitDirs, want)
+	}
+
+	rr := httptest.NewRecorder()
+	s.handleList(rr, httptest.NewRequest("GET", "/list?cloned", nil))
+	var repos []string
+	if err := json.Unmarshal(rr.Body.Bytes(), &repos); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(repos)
+	if want := []string{"example.com/foo/bar", "example.com/foo/bar/sub/nested"}; !reflect.DeepEqual(repos, want) {
+		t.Errorf("got cloned repos %v, want %v", repos, want)
+	}
+}
@@ -3,6 +3,8 @@ package repos
 import (
 	"container/heap"
 	"context"
+	"reflect"
+	"regexp"
 	"sort"
 	"sync"
 	"time"
@@ -13,6 +15,7 @@ import (
 	gitserverprotocol "github.com/sourcegraph/sourcegraph/internal/gitserver/protocol"
 	"github.com/sourcegraph/sourcegraph/internal/mutablelimiter"
 	"github.com/sourcegraph/sourcegraph/internal/repoupdater/protocol"
+	"github.com/sourcegraph/sourcegraph/schema"
 	log15 "gopkg.in/inconshreveable/log15.v2"
 )
 
@@ -32,6 +35,8 @@ func RunScheduler(ctx context.Context, scheduler *updateScheduler) {
 	conf.Watch(func() {
 		c := conf.Get()
 
+		scheduler.schedule.setIntervals(c.GitUpdateInterval)
+
 		want := schedulerConfig{
 			running:               true,
 			autoGitUpdatesEnabled: !c.DisableAutoGitUpdates,
@@ -90,6 +95,9 @@ const (
 // then the next update will be scheduled 6 hours from then.
 // This heuristic is simple to compute and has nice backoff properties.
 //
+// Repos matching a pattern of the gitUpdateInterval site configuration are
+// instead updated at the configured interval.
+//
 // When it is time for a repo to update, the scheduler inserts the repo into a queue.
 //
 // A worker continuously dequeues repos and sends updates to gitserver, but its concurrency
@@ -131,8 +139,9 @@ func NewUpdateScheduler() *updateScheduler {
 			notifyEnqueue: make(chan struct{}, notifyChanBuffer),
 		},
 		schedule: &schedule{
-			index:  make(map[uint32]*scheduledRepoUpdate),
-			wakeup: make(chan struct{}, notifyChanBuffer),
+			index:     make(map[uint32]*scheduledRepoUpdate),
+			wakeup:    make(chan struct{}, notifyChanBuffer),
+			intervals: &updateIntervals{},
 		},
 	}
 }
@@ -619,6 +628,9 @@ type schedule struct {
 	// timer sends a value on the wakeup channel when it is time
 	timer  *time.Timer
 	wakeup chan struct{}
+
+	// intervals overrides the update interval of repos.
+	intervals *updateIntervals
 }
 
 // scheduledRepoUpdate is the update schedule for a single repo.
@@ -630,23 +642,36 @@ type scheduledRepoUpdate struct {
 }
 
 // upsert inserts or updates a repo in the schedule.
+//
+// New repos are due after minDelay, or after the interval configured for them
+// in the gitUpdateInterval site configuration.
 func (s *schedule) upsert(repo *configuredRepo2) (updated bool) {
 	if repo.ID == 0 {
 		panic("repo.id is zero")
 	}
 
+	override, hasOverride := s.intervals.lookup(repo.Name)
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	if update := s.index[repo.ID]; update != nil {
 		update.Repo = repo
+		if hasOverride && update.Interval != override {
+			s.applyInterval(update, override)
+			s.rescheduleTimer()
+		}
 		return true
 	}
 
+	interval := minDelay
+	if hasOverride {
+		interval = override
+	}
 	heap.Push(s, &scheduledRepoUpdate{
 		Repo:     repo,
-		Interval: minDelay,
-		Due:      timeNow().Add(minDelay),
+		Interval: interval,
+		Due:      timeNow().Add(interval),
 	})
 
 	s.rescheduleTimer()
@@ -656,14 +681,22 @@ func (s *schedule) upsert(repo *configuredRepo2) (updated bool) {
 
 // updateInterval updates the update interval of a repo in the schedule.
 // It does nothing if the repo is not in the schedule.
+//
+// The interval configured for the repo in the gitUpdateInterval site
+// configuration takes precedence over interval. It is not limited by maxDelay,
+// so rarely changing repos can be updated less often.
 func (s *schedule) updateInterval(repo *configuredRepo2, interval time.Duration) {
 	if repo.ID == 0 {
 		panic("repo.id is zero")
 	}
 
+	override, hasOverride := s.intervals.lookup(repo.Name)
+
 	s.mu.Lock()
 	if update := s.index[repo.ID]; update != nil {
 		switch {
+		case hasOverride:
+			update.Interval = override
 		case interval > maxDelay:
 			update.Interval = maxDelay
 		case interval < minDelay:
@@ -679,6 +712,44 @@ func (s *schedule) updateInterval(repo *configuredRepo2, interval time.Duration)
 	s.mu.Unlock()
 }
 
+// setIntervals sets the rules of the gitUpdateInterval site configuration. If
+// they changed, the repos in the schedule are rescheduled according to them.
+// The intervals of repos no longer matching any rule are limited to maxDelay
+// until their next update recomputes them.
+func (s *schedule) setIntervals(rules []*schema.UpdateIntervalRule) {
+	if !s.intervals.set(rules) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, update := range s.heap {
+		interval, ok := s.intervals.lookup(update.Repo.Name)
+		switch {
+		case ok:
+		case update.Interval > maxDelay:
+			interval = maxDelay
+		default:
+			continue
+		}
+		if update.Interval != interval {
+			s.applyInterval(update, interval)
+		}
+	}
+	s.rescheduleTimer()
+}
+
+// applyInterval sets the interval of update, bringing its due time forward
+// if the new interval elapses before. The caller must hold the lock on s.mu.
+func (s *schedule) applyInterval(update *scheduledRepoUpdate, interval time.Duration) {
+	update.Interval = interval
+	if due := timeNow().Add(interval); due.Before(update.Due) {
+		update.Due = due
+		heap.Fix(s, update.Index)
+	}
+}
+
 // remove removes a repo from the schedule.
 func (s *schedule) remove(repo *configuredRepo2) (removed bool) {
 	if repo.ID == 0 {
@@ -761,6 +832,70 @@ func (s *schedule) Pop() interface{} {
 	return item
 }
 
+// updateIntervals matches repo names against the rules of the
+// gitUpdateInterval site configuration. The result of a lookup is cached per
+// repo name until the rules change, so the patterns are only evaluated once
+// per repo.
+type updateIntervals struct {
+	mu    sync.Mutex
+	rules []*schema.UpdateIntervalRule
+	res   []*regexp.Regexp
+	cache map[api.RepoName]time.Duration // 0 if no rule matches
+}
+
+// set replaces the rules and reports whether they changed. Rules with an
+// invalid pattern or an interval of less than a minute are ignored.
+func (u *updateIntervals) set(rules []*schema.UpdateIntervalRule) (changed bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if reflect.DeepEqual(u.rules, rules) {
+		return false
+	}
+
+	u.rules = rules
+	u.res = make([]*regexp.Regexp, len(rules))
+	u.cache = nil
+	for i, r := range rules {
+		if r.Interval < 1 {
+			continue
+		}
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			log15.Error("invalid gitUpdateInterval pattern", "pattern", r.Pattern, "err", err)
+			continue
+		}
+		u.res[i] = re
+	}
+	return true
+}
+
+// lookup returns the interval of the first rule matching name. ok is false
+// if no rule matches.
+func (u *updateIntervals) lookup(name api.RepoName) (interval time.Duration, ok bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if len(u.rules) == 0 {
+		return 0, false
+	}
+
+	interval, cached := u.cache[name]
+	if !cached {
+		for i, re := range u.res {
+			if re != nil && re.MatchString(string(name)) {
+				interval = time.Duration(u.rules[i].Interval) * time.Minute
+				break
+			}
+		}
+		if u.cache == nil {
+			u.cache = make(map[api.RepoName]time.Duration)
+		}
+		u.cache[name] = interval
+	}
+	return interval, interval > 0
+}
+
 // notify performs a non-blocking send on the channel.
 // The channel should be buffered.
 var notify = func(ch chan struct{}) {
@@ -12,6 +12,7 @@ import (
 	"github.com/sourcegraph/sourcegraph/internal/api"
 	gitserverprotocol "github.com/sourcegraph/sourcegraph/internal/gitserver/protocol"
 	"github.com/sourcegraph/sourcegraph/internal/mutablelimiter"
+	"github.com/sourcegraph/sourcegraph/schema"
 )
 
 var defaultTime = time.Date(2000, 1, 1, 1, 1, 1, 1, time.UTC)
@@ -877,6 +878,125 @@ func TestSchedule_updateInterval(t *testing.T) {
 	}
 }
 
+func TestSchedule_updateInterval_override(t *testing.T) {
+	busy := &configuredRepo2{ID: 1, Name: "github.com/foo/busy", URL: "a.com"}
+	other := &configuredRepo2{ID: 2, Name: "github.com/foo/other", URL: "b.com"}
+	archive := &configuredRepo2{ID: 3, Name: "github.com/foo/archive-old", URL: "c.com"}
+
+	_, stop := startRecording()
+	defer stop()
+
+	s := NewUpdateScheduler()
+	s.schedule.intervals.set([]*schema.UpdateIntervalRule{
+		{Pattern: "(", Interval: 5},
+		{Pattern: "^github\\.com/foo/busy$", Interval: 1},
+		{Pattern: "^github\\.com/foo/archive-", Interval: 24 * 60},
+		{Pattern: "^github\\.com/foo/", Interval: 0},
+	})
+	setupInitialSchedule(s, []*scheduledRepoUpdate{
+		{Repo: other, Interval: minDelay, Due: defaultTime.Add(minDelay)},
+		{Repo: archive, Interval: minDelay, Due: defaultTime.Add(minDelay)},
+		{Repo: busy, Interval: minDelay, Due: defaultTime.Add(minDelay)},
+	})
+
+	// All repos were last fetched at the same time and the heuristic
+	// interval is the same for all of them.
+	for _, repo := range []*configuredRepo2{other, archive, busy} {
+		s.schedule.updateInterval(repo, time.Hour)
+	}
+
+	verifySchedule(t, s, []*scheduledRepoUpdate{
+		{Repo: busy, Interval: time.Minute, Due: defaultTime.Add(time.Minute)},
+		{Repo: other, Interval: time.Hour, Due: defaultTime.Add(time.Hour)},
+		{Repo: archive, Interval: 24 * time.Hour, Due: defaultTime.Add(24 * time.Hour)},
+	})
+}
+
+func TestSchedule_upsert_override(t *testing.T) {
+	busy := &configuredRepo2{ID: 1, Name: "github.com/foo/busy", URL: "a.com"}
+	other := &configuredRepo2{ID: 2, Name: "github.com/foo/other", URL: "b.com"}
+	archive := &configuredRepo2{ID: 3, Name: "github.com/foo/archive-old", URL: "c.com"}
+
+	_, stop := startRecording()
+	defer stop()
+
+	s := NewUpdateScheduler()
+	s.schedule.intervals.set([]*schema.UpdateIntervalRule{
+		{Pattern: "^github\\.com/foo/busy$", Interval: 1},
+		{Pattern: "^github\\.com/foo/archive-", Interval: 24 * 60},
+	})
+	setupInitialSchedule(s, []*scheduledRepoUpdate{
+		{Repo: busy, Interval: time.Hour, Due: defaultTime.Add(time.Hour)},
+	})
+
+	// New repos are scheduled with their override, existing repos are
+	// rescheduled if their override differs.
+	for _, repo := range []*configuredRepo2{busy, other, archive} {
+		s.schedule.upsert(repo)
+	}
+
+	verifySchedule(t, s, []*scheduledRepoUpdate{
+		{Repo: other, Interval: minDelay, Due: defaultTime.Add(minDelay)},
+		{Repo: busy, Interval: time.Minute, Due: defaultTime.Add(time.Minute)},
+		{Repo: archive, Interval: 24 * time.Hour, Due: defaultTime.Add(24 * time.Hour)},
+	})
+}
+
+func TestSchedule_setIntervals(t *testing.T) {
+	busy := &configuredRepo2{ID: 1, Name: "github.com/foo/busy", URL: "a.com"}
+	other := &configuredRepo2{ID: 2, Name: "github.com/foo/other", URL: "b.com"}
+	archive := &configuredRepo2{ID: 3, Name: "github.com/foo/archive-old", URL: "c.com"}
+
+	_, stop := startRecording()
+	defer stop()
+
+	s := NewUpdateScheduler()
+	s.schedule.setIntervals([]*schema.UpdateIntervalRule{
+		{Pattern: "^github\\.com/foo/archive-", Interval: 24 * 60},
+	})
+	setupInitialSchedule(s, []*scheduledRepoUpdate{
+		{Repo: busy, Interval: time.Hour, Due: defaultTime.Add(time.Hour)},
+		{Repo: other, Interval: time.Hour, Due: defaultTime.Add(time.Hour)},
+		{Repo: archive, Interval: 24 * time.Hour, Due: defaultTime.Add(24 * time.Hour)},
+	})
+
+	// Changing the rules reschedules the repos in the schedule: busy is due
+	// sooner, archive no longer exceeds maxDelay.
+	s.schedule.setIntervals([]*schema.UpdateIntervalRule{
+		{Pattern: "^github\\.com/foo/busy$", Interval: 1},
+	})
+
+	verifySchedule(t, s, []*scheduledRepoUpdate{
+		{Repo: busy, Interval: time.Minute, Due: defaultTime.Add(time.Minute)},
+		{Repo: other, Interval: time.Hour, Due: defaultTime.Add(time.Hour)},
+		{Repo: archive, Interval: maxDelay, Due: defaultTime.Add(maxDelay)},
+	})
+}
+
+func TestUpdateIntervals_lookup(t *testing.T) {
+	var u updateIntervals
+	if _, ok := u.lookup("github.com/foo/bar"); ok {
+		t.Fatal("expected no interval without rules")
+	}
+
+	u.set([]*schema.UpdateIntervalRule{{Pattern: "^github\\.com/", Interval: 10}})
+	if got, ok := u.lookup("github.com/foo/bar"); !ok || got != 10*time.Minute {
+		t.Fatalf("got interval %v, %v; want 10m, true", got, ok)
+	}
+	if _, ok := u.lookup("gitlab.com/foo/bar"); ok {
+		t.Fatal("expected no interval for a repo not matching any rule")
+	}
+
+	// Cached lookups are invalidated when the rules change.
+	u.set([]*schema.UpdateIntervalRule{{Pattern: "^gitlab\\.com/", Interval: 20}})
+	if _, ok := u.lookup("github.com/foo/bar"); ok {
+		t.Fatal("expected no interval after the rules changed")
+	}
+	if got, ok := u.lookup("gitlab.com/foo/bar"); !ok || got != 20*time.Minute {
+		t.Fatalf("got interval %v, %v; want 20m, true", got, ok)
+	}
+}
+
 func TestSchedule_remove(t *testing.T) {
 	a := &configuredRepo2{ID: 1, Name: "a", URL: "a.com"}
 	b := &configuredRepo2{ID: 2, Name: "b", URL: "b.com"}
@@ -565,6 +565,34 @@ func (c *Client) RequestRepoUpdate(ctx context.Context, repo Repo, since time.Du
 	return info, err
 }
 
+// EnsureCommit ensures repo contains commit, fetching only that commit if
+// the code host allows it. If repo is not cloned yet, it is cloned instead.
+func (c *Client) EnsureCommit(ctx context.Context, repo Repo, commit string) error {
+	req := &protocol.RepoUpdateRequest{
+		Repo:   repo.Name,
+		URL:    repo.URL,
+		Commit: commit,
+	}
+	resp, err := c.httpPost(ctx, repo.Name, "repo-update", req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 200))
+		return &url.Error{URL: resp.Request.URL.String(), Op: "EnsureCommit", Err: fmt.Errorf("EnsureCommit: http status %d: %s", resp.StatusCode, body)}
+	}
+
+	var info protocol.RepoUpdateResponse
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return err
+	}
+	if info.Error != "" {
+		return errors.New(info.Error)
+	}
+	return nil
+}
+
 // MockIsRepoCloneable mocks (*Client).IsRepoCloneable for tests.
 var MockIsRepoCloneable func(Repo) error
 
@@ -747,6 +775,80 @@ func (c *Client) Remove(ctx context.Context, repo api.RepoName) error {
 	return nil
 }
 
+// CheckRefs checks that the refs of repo point at objects which exist on
+// gitserver. If repair is true, refs pointing at missing objects are
+// deleted, so the next update fetches them again.
+func (c *Client) CheckRefs(ctx context.Context, repo api.RepoName, repair bool) (*protocol.RepoRefsCheckResponse, error) {
+	req := &protocol.RepoRefsCheckRequest{
+		Repo:   repo,
+		Repair: repair,
+	}
+	resp, err := c.httpPost(ctx, repo, "repo-refs-check", req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		// best-effort inclusion of body in error message
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 200))
+		return nil, &url.Error{URL: resp.Request.URL.String(), Op: "CheckRefs", Err: fmt.Errorf("CheckRefs: http status %d: %s", resp.StatusCode, string(body))}
+	}
+	var info protocol.RepoRefsCheckResponse
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// Repack repacks repo on gitserver. It fails if repo is being cloned or
+// updated.
+func (c *Client) Repack(ctx context.Context, repo api.RepoName, aggressive bool) (*protocol.RepoRepackResponse, error) {
+	req := &protocol.RepoRepackRequest{
+		Repo:       repo,
+		Aggressive: aggressive,
+	}
+	resp, err := c.httpPost(ctx, repo, "repo-repack", req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		// best-effort inclusion of body in error message
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 200))
+		return nil, &url.Error{URL: resp.Request.URL.String(), Op: "Repack", Err: fmt.Errorf("Repack: http status %d: %s", resp.StatusCode, string(body))}
+	}
+	var info protocol.RepoRepackResponse
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// RenameRepo moves repo on gitserver to newName, keeping its clone. It
+// fails if repo is being cloned or updated, or if both names are
+// assigned to different gitservers, in which case newName has to be
+// cloned.
+func (c *Client) RenameRepo(ctx context.Context, repo, newName api.RepoName) error {
+	if c.addrForRepo(ctx, repo) != c.addrForRepo(ctx, newName) {
+		return fmt.Errorf("RenameRepo: %s and %s are on different gitservers", repo, newName)
+	}
+	req := &protocol.RepoRenameRequest{
+		Repo:    repo,
+		NewName: newName,
+	}
+	resp, err := c.httpPost(ctx, repo, "repo-rename", req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		// best-effort inclusion of body in error message
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 200))
+		return &url.Error{URL: resp.Request.URL.String(), Op: "RenameRepo", Err: fmt.Errorf("RenameRepo: http status %d: %s", resp.StatusCode, string(body))}
+	}
+	return nil
+}
+
 func (c *Client) httpPost(ctx context.Context, repo api.RepoName, op string, payload interface{}) (resp *http.Response, err error) {
 	return c.do(ctx, repo, "POST", op, payload)
 }
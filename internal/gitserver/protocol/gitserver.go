@@ -39,11 +39,22 @@ type HTTPSConfig struct {
 	Pass string `json:"pass"` // the password provided to the remote
 }
 
+// GitConfigHeader is the HTTP header of requests to the repo-update and
+// is-repo-cloneable endpoints which sets git config for the clone or fetch
+// of that request only. Each value is a "key=value" pair. Only
+// http.extraHeader is allowed, and requests with other keys are rejected.
+const GitConfigHeader = "X-Sourcegraph-Git-Config"
+
 // RepoUpdateRequest is a request to update the contents of a given repo, or clone it if it doesn't exist.
 type RepoUpdateRequest struct {
 	Repo  api.RepoName  `json:"repo"`  // identifying URL for repo
 	URL   string        `json:"url"`   // repo's remote URL
 	Since time.Duration `json:"since"` // debounce interval for queries, used only with request-repo-update
+
+	// Commit, if set, is a commit ID to ensure the repository contains. Only
+	// that commit is fetched if the remote allows it, and the update is not
+	// debounced.
+	Commit string `json:"commit,omitempty"`
 }
 
 // RepoUpdateResponse returns meta information of the repo enqueued for
@@ -104,6 +115,76 @@ type RepoDeleteRequest struct {
 	Repo api.RepoName
 }
 
+// RepoRefsCheckRequest is a request to check that the refs of a repository
+// clone on gitserver point at objects which exist, e.g. after an interrupted
+// fetch.
+type RepoRefsCheckRequest struct {
+	// Repo is the repository to check.
+	Repo api.RepoName
+
+	// Repair deletes the refs pointing at missing objects. The next fetch
+	// recreates them from the remote.
+	Repair bool
+}
+
+// RepoRefsCheckResponse is the response to a RepoRefsCheckRequest.
+type RepoRefsCheckResponse struct {
+	// DanglingRefs are the refs pointing at missing objects.
+	DanglingRefs []DanglingRef
+
+	// Repaired is whether DanglingRefs were deleted.
+	Repaired bool
+}
+
+// DanglingRef is a ref pointing at a missing object.
+type DanglingRef struct {
+	Name string // full name of the ref, e.g. refs/heads/master
+	OID  string // the missing object
+}
+
+// RepoRepackRequest is a request to repack a repository clone on gitserver
+// immediately, rather than waiting for the janitor.
+type RepoRepackRequest struct {
+	// Repo is the repository to repack.
+	Repo api.RepoName
+
+	// Aggressive additionally runs git gc --aggressive, which recomputes all
+	// deltas. It is much slower than a repack.
+	Aggressive bool
+}
+
+// RepoRepackResponse is the response to a RepoRepackRequest.
+type RepoRepackResponse struct {
+	// SizeBefore and SizeAfter are the size in bytes of the repository
+	// before and after repacking it.
+	SizeBefore int64
+	SizeAfter  int64
+}
+
+// CapabilitiesResponse is the response of the capabilities endpoint of a
+// gitserver, for comparing gitservers across a fleet.
+type CapabilitiesResponse struct {
+	// GitVersion is the major and minor version of the installed git, e.g.
+	// "2.24", or empty if it could not be determined.
+	GitVersion string
+
+	// Features maps each optional feature of gitserver to whether it is
+	// enabled. A feature which requires a newer git is reported as
+	// disabled.
+	Features map[string]bool
+}
+
+// RepoRenameRequest is a request to move a repository clone on gitserver to
+// a new name instead of cloning it again.
+type RepoRenameRequest struct {
+	// Repo is the current name of the repository.
+	Repo api.RepoName
+
+	// NewName is the name to move the repository to. It must not be cloned
+	// yet.
+	NewName api.RepoName
+}
+
 // RepoInfo is the information requests about a single repository
 // via a RepoInfoRequest.
 type RepoInfo struct {
@@ -118,6 +199,34 @@ type RepoInfo struct {
 	// recloned automatically, so this time is likely to move forward
 	// periodically.
 	CloneTime *time.Time
+
+	// LastFetchError is the most recent fetch failure. It is nil if the last
+	// fetch succeeded.
+	LastFetchError *FetchError `json:",omitempty"`
+
+	// Shallow is whether the clone has truncated history.
+	Shallow bool `json:",omitempty"`
+
+	// Empty is whether the repository was cloned but has no commits.
+	Empty bool `json:",omitempty"`
+
+	// Corrupt describes why the repository appears corrupt, e.g. "missing
+	// HEAD". It is empty for healthy repositories.
+	Corrupt string `json:",omitempty"`
+
+	// FallbackRemote is the fallback remote URL, without credentials, the
+	// last fetch succeeded from. It is empty if it succeeded from URL.
+	FallbackRemote string `json:",omitempty"`
+}
+
+// FetchError describes the most recent failures to fetch a repository. Clients
+// can use ConsecutiveFailures to stop scheduling updates for repositories
+// which repeatedly fail, e.g. because the upstream was deleted.
+type FetchError struct {
+	Category            string    // coarse classification: "not-found", "unauthorized", "network" or "unknown"
+	Message             string    // output of the failed fetch, with credentials redacted
+	Time                time.Time // when the most recent failure occurred
+	ConsecutiveFailures int       // number of failed fetches since the last successful fetch
 }
 
 // RepoInfoResponse is the response to a repository information request
@@ -878,6 +878,8 @@ type SiteConfiguration struct {
 	GitCloneURLToRepositoryName []*CloneURLToRepositoryName `json:"git.cloneURLToRepositoryName,omitempty"`
 	// GitMaxConcurrentClones description: Maximum number of git clone processes that will be run concurrently to update repositories.
 	GitMaxConcurrentClones int `json:"gitMaxConcurrentClones,omitempty"`
+	// GitUpdateInterval description: JSON array of repository name patterns with the interval (in minutes) at which matching repositories are fetched from their code host. The first matching pattern is used. Repositories which do not match any pattern are fetched at an interval based on how recently they changed.
+	GitUpdateInterval []*UpdateIntervalRule `json:"gitUpdateInterval,omitempty"`
 	// GithubClientID description: Client ID for GitHub.
 	GithubClientID string `json:"githubClientID,omitempty"`
 	// GithubClientSecret description: Client secret for GitHub.
@@ -897,6 +899,12 @@ type SiteConfiguration struct {
 	// SearchLargeFiles description: A list of file glob patterns where matching files will be indexed and searched regardless of their size. The glob pattern syntax can be found here: https://golang.org/pkg/path/filepath/#Match.
 	SearchLargeFiles []string `json:"search.largeFiles,omitempty"`
 }
+type UpdateIntervalRule struct {
+	// Interval description: The interval (in minutes) between fetches of matching repositories.
+	Interval int `json:"interval"`
+	// Pattern description: A regular expression matched against repository names, e.g. "^github\.com/myorg/".
+	Pattern string `json:"pattern"`
+}
 type UsernameIdentity struct {
 	Type string `json:"type"`
 }
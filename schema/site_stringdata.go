@@ -140,6 +140,30 @@ const SiteSchemaJSON = `{
       "default": 5,
       "group": "External services"
     },
+    "gitUpdateInterval": {
+      "description": "JSON array of repository name patterns with the interval (in minutes) at which matching repositories are fetched from their code host. The first matching pattern is used. Repositories which do not match any pattern are fetched at an interval based on how recently they changed.",
+      "type": "array",
+      "items": {
+        "type": "object",
+        "title": "UpdateIntervalRule",
+        "additionalProperties": false,
+        "required": ["pattern", "interval"],
+        "properties": {
+          "pattern": {
+            "description": "A regular expression matched against repository names, e.g. \"^github\\.com/myorg/\".",
+            "type": "string",
+            "format": "regex"
+          },
+          "interval": {
+            "description": "The interval (in minutes) between fetches of matching repositories.",
+            "type": "integer",
+            "minimum": 1
+          }
+        }
+      },
+      "examples": [[{ "pattern": "^github\\.com/myorg/busy", "interval": 1 }, { "pattern": "^github\\.com/myorg/archive-", "interval": 1440 }]],
+      "group": "External services"
+    },
     "repoListUpdateInterval": {
       "description": "Interval (in minutes) for checking code hosts (such as GitHub, Gitolite, etc.) for new repositories.",
       "type": "integer",